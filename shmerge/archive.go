@@ -0,0 +1,394 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// archiveTables lists archive tables, they are merged after all other tables
+var archiveTables = []string{
+	"uidentities_archive",
+	"profiles_archive",
+	"identities_archive",
+	"enrollments_archive",
+}
+
+// loadArchives schedules reading all archive tables from dbNum-th database into s using g
+// Organization IDs of archived enrollments are mapped to names later, together with enrollments
+func loadArchives(g *group, db *sql.DB, dbNum int, s *snapshot) {
+	g.do(func(ctx context.Context) error {
+		var (
+			archivedAt time.Time
+			uuid       string
+			modified   *time.Time
+		)
+		return queryRows(ctx, db, "uidentities_archive", dbNum, "select archived_at, uuid, last_modified from uidentities_archive", func(rows *sql.Rows) error {
+			err := rows.Scan(&archivedAt, &uuid, &modified)
+			if err != nil {
+				return err
+			}
+			toUTC(&archivedAt, modified)
+			s.uidentitiesArchive[ArchiveKey{Key: uuid, ArchivedAt: archivedAt}] = modified
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var archivedAt time.Time
+		var p Profile
+		return queryRows(ctx, db, "profiles_archive", dbNum, "select archived_at, uuid, name, email, gender, gender_acc, is_bot, country_code from profiles_archive", func(rows *sql.Rows) error {
+			err := rows.Scan(&archivedAt, &p.UUID, &p.Name, &p.Email, &p.Gender, &p.GenderAcc, &p.IsBot, &p.CountryCode)
+			if err != nil {
+				return err
+			}
+			toUTC(&archivedAt)
+			s.profilesArchive[ArchiveKey{Key: p.UUID, ArchivedAt: archivedAt}] = p
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var archivedAt time.Time
+		var iy Identity
+		return queryRows(ctx, db, "identities_archive", dbNum, "select archived_at, id, name, email, username, source, uuid, last_modified from identities_archive", func(rows *sql.Rows) error {
+			err := rows.Scan(&archivedAt, &iy.ID, &iy.Name, &iy.Email, &iy.Username, &iy.Source, &iy.UUID, &iy.LastModified)
+			if err != nil {
+				return err
+			}
+			toUTC(&archivedAt, iy.LastModified)
+			s.identitiesArchive[ArchiveKey{Key: iy.ID, ArchivedAt: archivedAt}] = iy
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var archivedAt time.Time
+		var e Enrollment
+		return queryRows(ctx, db, "enrollments_archive", dbNum, "select archived_at, id, start, end, uuid, organization_id from enrollments_archive", func(rows *sql.Rows) error {
+			err := rows.Scan(&archivedAt, &e.ID, &e.Start, &e.End, &e.UUID, &e.OrgID)
+			if err != nil {
+				return err
+			}
+			toUTC(&archivedAt, &e.Start, &e.End)
+			s.enrollmentsArchive[ArchiveKey{Key: EnrollmentKey{Start: e.Start, End: e.End, UUID: e.UUID}.String(), ArchivedAt: archivedAt}] = e
+			return nil
+		})
+	})
+}
+
+// mergeArchive merges a single archive table, rows are deduplicated on their keys and the highest priority input wins
+// keys returns archive keys of i-th input, add adds i-th input row to merged rows unless they already have it
+func (m *Merger) mergeArchive(table string, plan *Plan, order []int, keys func(i int) []ArchiveKey, add func(i int, k ArchiveKey) bool) {
+	m.printf("%s...\n", table)
+	tp := plan.table(table)
+	seen := make(map[ArchiveKey]int)
+	for _, i := range order {
+		for _, k := range keys(i) {
+			seen[k]++
+			if add(i, k) {
+				tp.Added[i]++
+			} else if seen[k] == 2 {
+				tp.Merged++
+			}
+		}
+	}
+}
+
+// mergeArchives merges all archive tables into merged, order lists inputs from the highest to the lowest priority
+// Archive tables hold history, so their rows are never deleted by a three-way merge
+func (m *Merger) mergeArchives(srcs []*snapshot, order []int, plan *Plan, merged *snapshot) {
+	m.mergeArchive(
+		"uidentities_archive",
+		plan,
+		order,
+		func(i int) []ArchiveKey {
+			var keys []ArchiveKey
+			for k := range srcs[i].uidentitiesArchive {
+				keys = append(keys, k)
+			}
+			return keys
+		},
+		func(i int, k ArchiveKey) bool {
+			if _, ok := merged.uidentitiesArchive[k]; ok {
+				return false
+			}
+			merged.uidentitiesArchive[k] = srcs[i].uidentitiesArchive[k]
+			return true
+		},
+	)
+	m.mergeArchive(
+		"profiles_archive",
+		plan,
+		order,
+		func(i int) []ArchiveKey {
+			var keys []ArchiveKey
+			for k := range srcs[i].profilesArchive {
+				keys = append(keys, k)
+			}
+			return keys
+		},
+		func(i int, k ArchiveKey) bool {
+			if _, ok := merged.profilesArchive[k]; ok {
+				return false
+			}
+			merged.profilesArchive[k] = srcs[i].profilesArchive[k]
+			return true
+		},
+	)
+	m.mergeArchive(
+		"identities_archive",
+		plan,
+		order,
+		func(i int) []ArchiveKey {
+			var keys []ArchiveKey
+			for k := range srcs[i].identitiesArchive {
+				keys = append(keys, k)
+			}
+			return keys
+		},
+		func(i int, k ArchiveKey) bool {
+			if _, ok := merged.identitiesArchive[k]; ok {
+				return false
+			}
+			merged.identitiesArchive[k] = srcs[i].identitiesArchive[k]
+			return true
+		},
+	)
+	m.mergeArchive(
+		"enrollments_archive",
+		plan,
+		order,
+		func(i int) []ArchiveKey {
+			var keys []ArchiveKey
+			for k := range srcs[i].enrollmentsArchive {
+				keys = append(keys, k)
+			}
+			return keys
+		},
+		func(i int, k ArchiveKey) bool {
+			if _, ok := merged.enrollmentsArchive[k]; ok {
+				return false
+			}
+			merged.enrollmentsArchive[k] = srcs[i].enrollmentsArchive[k]
+			return true
+		},
+	)
+}
+
+// unmappedOrgID is written as organization_id of archived enrollments whose organization is missing in the merged database
+// Organization IDs start at 1, while the archived ID comes from another database and could point at an unrelated merged organization
+const unmappedOrgID = 0
+
+// mapArchivedOrg maps organization of archived enrollment e into merged organization ID using mapOrg, on a best-effort basis
+// Archive tables have no foreign keys, so enrollments archived before their organization was deleted get unmappedOrgID
+func (m *Merger) mapArchivedOrg(e Enrollment, key string, mapOrg func(table, orgName, key string) (int64, error)) (int64, error) {
+	if e.OrgName != "" {
+		id, err := mapOrg("enrollments_archive", e.OrgName, key)
+		if !errors.Is(err, ErrUnknownOrganization) {
+			return id, err
+		}
+	}
+	m.printf("Archived enrollment %s references organization %d missing in the merged database, writing organization ID %d\n", key, e.OrgID, unmappedOrgID)
+	return unmappedOrgID, nil
+}
+
+// writeArchives inserts all archive tables using tx, mapOrg maps organization name into merged organization ID
+func (m *Merger) writeArchives(ctx context.Context, tx *sql.Tx, s *snapshot, mapOrg func(table, orgName, key string) (int64, error)) error {
+	var keys []ArchiveKey
+	ins := m.newInserter(ctx, tx, "uidentities_archive", "archived_at", "uuid", "last_modified")
+	for k := range s.uidentitiesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		modified := s.uidentitiesArchive[k]
+		err := ins.add(k.String(), k.ArchivedAt, k.Key, modified)
+		if err != nil {
+			return err
+		}
+	}
+	err := ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "profiles_archive", "archived_at", "uuid", "name", "email", "gender", "gender_acc", "is_bot", "country_code")
+	keys = keys[:0]
+	for k := range s.profilesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		p := s.profilesArchive[k]
+		err := ins.add(k.String(), k.ArchivedAt, p.UUID, p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "identities_archive", "archived_at", "id", "name", "email", "username", "source", "uuid", "last_modified")
+	keys = keys[:0]
+	for k := range s.identitiesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		i := s.identitiesArchive[k]
+		err := ins.add(k.String(), k.ArchivedAt, i.ID, i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "enrollments_archive", "archived_at", "id", "start", "end", "uuid", "organization_id")
+	keys = keys[:0]
+	for k := range s.enrollmentsArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		e := s.enrollmentsArchive[k]
+		var err error
+		e.OrgIDMerged, err = m.mapArchivedOrg(e, k.String(), mapOrg)
+		if err != nil {
+			return err
+		}
+		err = ins.add(k.String(), k.ArchivedAt, e.ID, e.Start, e.End, e.UUID, e.OrgIDMerged)
+		if err != nil {
+			return err
+		}
+		s.enrollmentsArchive[k] = e
+	}
+	return ins.flush()
+}
+
+// writeArchivesDiff changes archive tables of a database holding target into merged data s, next returns writer for a table
+// Archive tables have no primary key, rows that differ are deleted and inserted again
+func (m *Merger) writeArchivesDiff(ctx context.Context, tx *sql.Tx, target, s *snapshot, mapOrg func(table, orgName, key string) (int64, error), next func(table string, columns ...string) (*diffWriter, error)) error {
+	w, err := next("uidentities_archive", "archived_at", "uuid", "last_modified")
+	if err != nil {
+		return err
+	}
+	var keys []ArchiveKey
+	for k := range s.uidentitiesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		modified := s.uidentitiesArchive[k]
+		tModified, ok := target.uidentitiesArchive[k]
+		if ok && (modified == nil) == (tModified == nil) && (modified == nil || modified.Equal(*tModified)) {
+			continue
+		}
+		if ok {
+			err = w.replace(k.String(), "delete from uidentities_archive where uuid = ? and archived_at = ?", []interface{}{k.Key, k.ArchivedAt}, k.ArchivedAt, k.Key, modified)
+		} else {
+			err = w.insert(k.String(), k.ArchivedAt, k.Key, modified)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k := range target.uidentitiesArchive {
+		if _, ok := s.uidentitiesArchive[k]; !ok {
+			w.delete(k.String(), "delete from uidentities_archive where uuid = ? and archived_at = ?", k.Key, k.ArchivedAt)
+		}
+	}
+	w, err = next("profiles_archive", "archived_at", "uuid", "name", "email", "gender", "gender_acc", "is_bot", "country_code")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for k := range s.profilesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		p := s.profilesArchive[k]
+		tp, ok := target.profilesArchive[k]
+		if ok && tp.String() == p.String() {
+			continue
+		}
+		if ok {
+			err = w.replace(k.String(), "delete from profiles_archive where uuid = ? and archived_at = ?", []interface{}{k.Key, k.ArchivedAt}, k.ArchivedAt, p.UUID, p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode)
+		} else {
+			err = w.insert(k.String(), k.ArchivedAt, p.UUID, p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k := range target.profilesArchive {
+		if _, ok := s.profilesArchive[k]; !ok {
+			w.delete(k.String(), "delete from profiles_archive where uuid = ? and archived_at = ?", k.Key, k.ArchivedAt)
+		}
+	}
+	w, err = next("identities_archive", "archived_at", "id", "name", "email", "username", "source", "uuid", "last_modified")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for k := range s.identitiesArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		i := s.identitiesArchive[k]
+		ti, ok := target.identitiesArchive[k]
+		if ok && ti.String() == i.String() {
+			continue
+		}
+		if ok {
+			err = w.replace(k.String(), "delete from identities_archive where id = ? and archived_at = ?", []interface{}{k.Key, k.ArchivedAt}, k.ArchivedAt, i.ID, i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified)
+		} else {
+			err = w.insert(k.String(), k.ArchivedAt, i.ID, i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k := range target.identitiesArchive {
+		if _, ok := s.identitiesArchive[k]; !ok {
+			w.delete(k.String(), "delete from identities_archive where id = ? and archived_at = ?", k.Key, k.ArchivedAt)
+		}
+	}
+	w, err = next("enrollments_archive", "archived_at", "id", "start", "end", "uuid", "organization_id")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for k := range s.enrollmentsArchive {
+		keys = append(keys, k)
+	}
+	sortArchiveKeys(keys)
+	for _, k := range keys {
+		e := s.enrollmentsArchive[k]
+		e.OrgIDMerged, err = m.mapArchivedOrg(e, k.String(), mapOrg)
+		if err != nil {
+			return err
+		}
+		s.enrollmentsArchive[k] = e
+		te, ok := target.enrollmentsArchive[k]
+		if ok && te.ID == e.ID && te.OrgID == e.OrgIDMerged {
+			continue
+		}
+		if ok {
+			err = w.replace(k.String(), "delete from enrollments_archive where uuid = ? and start = ? and end = ? and archived_at = ?", []interface{}{te.UUID, te.Start, te.End, k.ArchivedAt}, k.ArchivedAt, e.ID, e.Start, e.End, e.UUID, e.OrgIDMerged)
+		} else {
+			err = w.insert(k.String(), k.ArchivedAt, e.ID, e.Start, e.End, e.UUID, e.OrgIDMerged)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for k, te := range target.enrollmentsArchive {
+		if _, ok := s.enrollmentsArchive[k]; !ok {
+			w.delete(k.String(), "delete from enrollments_archive where uuid = ? and start = ? and end = ? and archived_at = ?", te.UUID, te.Start, te.End, k.ArchivedAt)
+		}
+	}
+	return nil
+}
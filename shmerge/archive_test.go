@@ -0,0 +1,51 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchivedEnrollmentOfDeletedOrganization(t *testing.T) {
+	// Google was deleted from the 2nd input, its enrollment was archived before
+	// its archived organization ID 1 is the ID of CNCF in the merged database
+	changed := `
+INSERT INTO countries VALUES ('PL','Poland','POL');
+INSERT INTO organizations VALUES (2,'CNCF');
+INSERT INTO domains_organizations VALUES (1,'cncf.io',1,2);
+INSERT INTO matching_blacklist VALUES ('root');
+INSERT INTO uidentities VALUES ('u1','2020-01-01 00:00:00.000000'),('u2','2020-01-01 00:00:00.000000');
+INSERT INTO profiles VALUES ('u1','User One',NULL,NULL,NULL,0,'PL'),('u2','User Two','two@x.com',NULL,NULL,0,NULL);
+INSERT INTO identities VALUES ('i1','User One',NULL,'u1','github','u1','2020-01-01 00:00:00.000000'),('i2','User Two','two@x.com','u2','git','u2','2020-01-01 00:00:00.000000');
+INSERT INTO enrollments VALUES (1,'1900-01-01 00:00:00','2100-01-01 00:00:00','u1',2);
+INSERT INTO enrollments_archive VALUES ('2020-02-01 00:00:00.000000',2,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',1);
+`
+	m := testMerger()
+	m.Base = openTestDump(t, testBase)
+	out := CreateDump(filepath.Join(t.TempDir(), "output.sql"))
+	err := m.Merge(context.Background(), []*sql.DB{openTestDump(t, testBase), openTestDump(t, changed)}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := loadTest(t, out)[0]
+	if _, ok := s.orgNames["google"]; ok {
+		t.Fatal("deleted organization restored because of an archived enrollment")
+	}
+	if len(s.enrollmentsArchive) != 1 {
+		t.Fatalf("got %d archived enrollments", len(s.enrollmentsArchive))
+	}
+	if s.orgs[1] != "CNCF" {
+		t.Fatalf("got organizations %v, want CNCF with ID 1", s.orgs)
+	}
+	for _, e := range s.enrollmentsArchive {
+		if e.OrgID != unmappedOrgID {
+			t.Fatalf("archived enrollment of a deleted organization got organization ID %d: %v", e.OrgID, e)
+		}
+	}
+	// the output database is a valid input, archived enrollments of unknown organizations don't fail merges
+	err = testMerger().Merge(context.Background(), []*sql.DB{out}, CreateDump(filepath.Join(t.TempDir(), "again.sql")))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	// DefaultBatchSize is the number of rows inserted by a single statement when Merger.BatchSize is not set
+	DefaultBatchSize = 500
+	// mysqlMaxPlaceholders is the maximum number of placeholders in a single MySQL statement
+	mysqlMaxPlaceholders = 65535
+)
+
+// placeholdersKey is the context key of the output database placeholders limit, set by writeDatabase
+type placeholdersKey struct{}
+
+// batchInserter inserts rows into a table using multi-row insert statements
+type batchInserter struct {
+	ctx     context.Context
+	tx      *sql.Tx
+	table   string
+	columns []string
+	size    int           // rows per statement
+	args    []interface{} // values of buffered rows
+	keys    []string      // keys of buffered rows, used in errors
+}
+
+// newInserter returns batch inserter for columns of table, rows are sent every m.BatchSize rows and on flush
+// Statements are kept below the placeholders limit of the output database dialect
+func (m *Merger) newInserter(ctx context.Context, tx *sql.Tx, table string, columns ...string) *batchInserter {
+	size := m.BatchSize
+	if size <= 0 {
+		size = DefaultBatchSize
+	}
+	limit, ok := ctx.Value(placeholdersKey{}).(int)
+	if !ok {
+		limit = mysqlMaxPlaceholders
+	}
+	if size*len(columns) > limit {
+		size = limit / len(columns)
+	}
+	return &batchInserter{ctx: ctx, tx: tx, table: table, columns: columns, size: size}
+}
+
+// add buffers a single row with a given key, values must match columns
+func (b *batchInserter) add(key string, values ...interface{}) error {
+	if len(values) != len(b.columns) {
+		return wrapError(fmt.Errorf("%d values given for %d columns", len(values), len(b.columns)), b.table, OutputDB, "insert", key)
+	}
+	b.args = append(b.args, values...)
+	b.keys = append(b.keys, key)
+	if len(b.keys) >= b.size {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush inserts all buffered rows
+func (b *batchInserter) flush() error {
+	n := len(b.keys)
+	if n == 0 {
+		return nil
+	}
+	row := "(?" + strings.Repeat(", ?", len(b.columns)-1) + ")"
+	query := "insert into " + b.table + "(" + strings.Join(b.columns, ", ") + ") values" + row + strings.Repeat(", "+row, n-1)
+	_, err := b.tx.ExecContext(b.ctx, query, b.args...)
+	if err != nil {
+		key := b.keys[0]
+		if n > 1 {
+			key = fmt.Sprintf("%s..%s (%d rows)", b.keys[0], b.keys[n-1], n)
+		}
+		return wrapError(err, b.table, OutputDB, "insert", key)
+	}
+	b.args = b.args[:0]
+	b.keys = b.keys[:0]
+	return nil
+}
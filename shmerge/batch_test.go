@@ -0,0 +1,38 @@
+package shmerge
+
+import (
+	"context"
+	"testing"
+)
+
+func TestInserterSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		columns   int
+		limit     int // 0 leaves the limit out of the context
+		want      int
+	}{
+		{"default", 0, 7, 0, DefaultBatchSize},
+		{"below MySQL limit", 9000, 7, 0, 9000},
+		{"MySQL limit", 20000, 7, 0, 65535 / 7},
+		{"SQLite limit", 20000, 7, 32766, 32766 / 7},
+		{"exact limit", 5, 2, 10, 5},
+		{"one over limit", 6, 2, 10, 5},
+		{"row by row", 1, 2, 10, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.limit > 0 {
+				ctx = context.WithValue(ctx, placeholdersKey{}, test.limit)
+			}
+			m := testMerger()
+			m.BatchSize = test.batchSize
+			ins := m.newInserter(ctx, nil, "t", make([]string, test.columns)...)
+			if ins.size != test.want {
+				t.Fatalf("got %d rows per statement, want %d", ins.size, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package shmerge
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const conflictsFileHeader = `# Conflicts found when merging Sorting Hat databases.
+# Edit "choice" of every conflict: "first" uses the row merged so far from higher priority inputs (first_db is where it was first taken from),
+# "second" uses the row of second_db, "merged" uses the version merged using policies.
+# Then run the merge again with this file applied, it fails if any input database changed in the meantime.
+`
+
+// FileConflict is a single conflict in a conflicts file
+type FileConflict struct {
+	Table    string `yaml:"table"`
+	Key      string `yaml:"key"`
+	FirstDB  int    `yaml:"first_db"` // input the merged row was first taken from
+	First    string `yaml:"first"`    // row merged so far from higher priority inputs
+	SecondDB int    `yaml:"second_db"`
+	Second   string `yaml:"second"`
+	Merged   string `yaml:"merged"`
+	Rule     string `yaml:"rule"`
+	Choice   Choice `yaml:"choice"` // proposed resolution, edited by the operator
+}
+
+// ConflictsFile holds conflicts exported for editing and applied in a later run
+type ConflictsFile struct {
+	Checksums []string       `yaml:"checksums"` // checksums of input databases in inputs order, base database checksum last when set
+	Conflicts []FileConflict `yaml:"conflicts"`
+}
+
+// Write writes conflicts file as YAML with a header explaining how to edit it
+func (f *ConflictsFile) Write(w io.Writer) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, conflictsFileHeader+string(data))
+	return err
+}
+
+// ReadConflictsFile reads a (possibly edited) conflicts file
+func ReadConflictsFile(r io.Reader) (*ConflictsFile, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	f := &ConflictsFile{}
+	err = yaml.UnmarshalStrict(data, f)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range f.Conflicts {
+		if c.Choice != ChooseFirst && c.Choice != ChooseSecond && c.Choice != ChooseMerged {
+			return nil, fmt.Errorf("invalid choice '%s' for %s %s, use %s, %s or %s", c.Choice, c.Table, c.Key, ChooseFirst, ChooseSecond, ChooseMerged)
+		}
+	}
+	return f, nil
+}
+
+// sort sorts conflicts by table (in foreign keys order) and key
+func (f *ConflictsFile) sort() {
+	tableIndex := func(table string) int {
+		for i, t := range mergedTables {
+			if t == table {
+				return i
+			}
+		}
+		return len(mergedTables)
+	}
+	sort.SliceStable(f.Conflicts, func(i, j int) bool {
+		ti, tj := tableIndex(f.Conflicts[i].Table), tableIndex(f.Conflicts[j].Table)
+		if ti != tj {
+			return ti < tj
+		}
+		return f.Conflicts[i].Key < f.Conflicts[j].Key
+	})
+}
+
+// exportResolver collects conflicts with resolutions proposed by the wrapped resolver (or policies)
+type exportResolver struct {
+	next Resolver
+	file *ConflictsFile
+}
+
+func (r *exportResolver) Resolve(c *PairConflict) (Choice, error) {
+	choice := ChooseMerged
+	if r.next != nil {
+		var err error
+		choice, err = r.next.Resolve(c)
+		if err != nil {
+			return "", err
+		}
+	}
+	r.file.Conflicts = append(
+		r.file.Conflicts,
+		FileConflict{Table: c.Table, Key: c.Key, FirstDB: c.DB1, First: c.First, SecondDB: c.DB2, Second: c.Second, Merged: c.Merged, Rule: c.Rule, Choice: choice},
+	)
+	return choice, nil
+}
+
+// fileResolver applies choices from a conflicts file, every conflict must be there
+type fileResolver struct {
+	choices map[string]Choice
+}
+
+func newFileResolver(f *ConflictsFile) *fileResolver {
+	r := &fileResolver{choices: make(map[string]Choice)}
+	for _, c := range f.Conflicts {
+		r.choices[decisionKey(c.Table, c.Key, c.First, c.Second)] = c.Choice
+	}
+	return r
+}
+
+func (r *fileResolver) Resolve(c *PairConflict) (Choice, error) {
+	choice, ok := r.choices[decisionKey(c.Table, c.Key, c.First, c.Second)]
+	if !ok {
+		return "", ErrNotInConflictsFile
+	}
+	return choice, nil
+}
+
+// checkChecksums returns ErrInputsChanged if checksums of n inputs (and the base) differ from ones in the conflicts file
+func checkChecksums(f *ConflictsFile, checksums []string, n int) error {
+	if len(f.Checksums) != len(checksums) {
+		return fmt.Errorf("%w: conflicts file has %d databases, merging %d", ErrInputsChanged, len(f.Checksums), len(checksums))
+	}
+	for i, sum := range checksums {
+		if f.Checksums[i] == sum {
+			continue
+		}
+		dbNum := i + 1
+		if i == n {
+			dbNum = BaseDB
+		}
+		return wrapError(ErrInputsChanged, "", dbNum, "check conflicts file", "")
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConflictsFileExportApply(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	inputs := []*sql.DB{openTestDump(t, testBase), openTestDump(t, testConflicting)}
+	var exported bytes.Buffer
+	m := testMerger()
+	m.ExportConflicts = &exported
+	err := m.Merge(ctx, inputs, CreateDump(filepath.Join(dir, "exported.sql")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "exported.sql")); !os.IsNotExist(err) {
+		t.Fatalf("output database written when exporting conflicts: %v", err)
+	}
+	if !strings.HasPrefix(exported.String(), conflictsFileHeader) {
+		t.Fatalf("conflicts file without header:\n%s", exported.String())
+	}
+	f, err := ReadConflictsFile(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, c := range f.Conflicts {
+		if c.Choice != ChooseMerged {
+			t.Fatalf("conflict %s %s proposes %s", c.Table, c.Key, c.Choice)
+		}
+		keys = append(keys, c.Table+" "+c.Key)
+	}
+	want := "countries PL,profiles u1,profiles u2,identities i1,identities i2," +
+		"enrollments u1 1900-01-01 00:00:00 2100-01-01 00:00:00,enrollments u2 1900-01-01 00:00:00 2100-01-01 00:00:00"
+	if strings.Join(keys, ",") != want {
+		t.Fatalf("got conflicts %s, want %s", strings.Join(keys, ","), want)
+	}
+	if len(f.Checksums) != 2 {
+		t.Fatalf("got %d checksums, want 2", len(f.Checksums))
+	}
+
+	// the operator edits choices, the edited file is written and read again
+	f.Conflicts[0].Choice = ChooseSecond
+	f.Conflicts[1].Choice = ChooseFirst
+	var edited bytes.Buffer
+	err = f.Write(&edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = ReadConflictsFile(&edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = testMerger()
+	m.ApplyConflicts = f
+	err = m.Merge(ctx, inputs, CreateDump(filepath.Join(dir, "applied.sql")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := OpenDump(filepath.Join(dir, "applied.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := loadTest(t, applied)[0]
+	if c := s.countries["PL"]; c.Name != "Polska" {
+		t.Fatalf("got country %v, want the second version", c)
+	}
+	// merged using policies would take the non-null email of the second version
+	if p := s.profiles["u1"]; p.Email != nil {
+		t.Fatalf("got profile %v, want the first version", p)
+	}
+	if p := s.profiles["u2"]; p.Name == nil || *p.Name != "User Two" {
+		t.Fatalf("got profile %v, want the merged version", p)
+	}
+
+	// a conflict missing in the file fails the merge
+	missing := *f
+	missing.Conflicts = f.Conflicts[1:]
+	m = testMerger()
+	m.ApplyConflicts = &missing
+	err = m.Merge(ctx, inputs, CreateDump(filepath.Join(dir, "missing.sql")))
+	if !errors.Is(err, ErrNotInConflictsFile) {
+		t.Fatalf("got %v, want %v", err, ErrNotInConflictsFile)
+	}
+}
+
+func TestConflictsFileInputsChanged(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	var exported bytes.Buffer
+	m := testMerger()
+	m.ExportConflicts = &exported
+	err := m.Merge(ctx, []*sql.DB{openTestDump(t, testBase), openTestDump(t, testConflicting)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadConflictsFile(&exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		inputs []*sql.DB
+		err    string
+	}{
+		{"changed", []*sql.DB{openTestDump(t, testBase), openTestDump(t, testCased)}, "check conflicts file (2nd input database): database changed since conflicts file was written"},
+		{"reordered", []*sql.DB{openTestDump(t, testConflicting), openTestDump(t, testBase)}, "check conflicts file (1st input database): database changed since conflicts file was written"},
+		{"added", []*sql.DB{openTestDump(t, testBase), openTestDump(t, testConflicting), openTestDump(t, testCased)}, "database changed since conflicts file was written: conflicts file has 2 databases, merging 3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name+".sql")
+			m := testMerger()
+			m.ApplyConflicts = f
+			err := m.Merge(ctx, test.inputs, CreateDump(path))
+			if !errors.Is(err, ErrInputsChanged) || err.Error() != test.err {
+				t.Fatalf("got %v, want %s", err, test.err)
+			}
+			if _, err = os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("output database written: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadConflictsFileErrors(t *testing.T) {
+	tests := []struct {
+		name, data, err string
+	}{
+		{"choice", "conflicts:\n- table: countries\n  key: PL\n  choice: third\n", "invalid choice 'third' for countries PL, use first, second or merged"},
+		{"unknown field", "conflicts:\n- table: countries\n  chioce: first\n", "yaml: unmarshal errors:\n  line 3: field chioce not found in type shmerge.FileConflict"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadConflictsFile(strings.NewReader(test.data))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
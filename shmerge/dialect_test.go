@@ -0,0 +1,83 @@
+package shmerge
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPortableSchemaOrder(t *testing.T) {
+	created := make(map[string]bool)
+	for _, stmt := range portableSchema() {
+		stmt = rewritePostgres(stmt)
+		fields := strings.Fields(stmt)
+		if len(fields) < 6 || strings.Join(fields[:5], " ") != "create table if not exists" {
+			t.Fatalf("unexpected statement %s", stmt)
+		}
+		name := fields[5]
+		for _, mysql := range []string{"AUTO_INCREMENT", "int(", "datetime"} {
+			if strings.Contains(stmt, mysql) {
+				t.Errorf("table %s keeps MySQL %s: %s", name, mysql, stmt)
+			}
+		}
+		for _, m := range foreignKeyReference.FindAllStringSubmatch(stmt, -1) {
+			if !created[m[1]] {
+				t.Errorf("table %s references table %s created later", name, m[1])
+			}
+		}
+		created[name] = true
+	}
+	for name := range schemaTables() {
+		if !created[name] {
+			t.Errorf("table %s not created", name)
+		}
+	}
+}
+
+func TestRewritePostgres(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"placeholders", "select id from organizations where id = ? and name = ?", "select id from organizations where id = $1 and name = $2"},
+		{"literal", "select '?' from t where a = ? and b = 'x ? y'", "select '?' from t where a = $1 and b = 'x ? y'"},
+		{"escaped quote", "select 'it''s ?', ? from t", "select 'it''s ?', $1 from t"},
+		{"backticks", "select `id`, `name` from `organizations`", `select "id", "name" from "organizations"`},
+		{"end", "insert into enrollments(start, end, `end`, \"end\") values(?, ?, 'end', ?)", `insert into enrollments(start, "end", "end", "end") values($1, $2, 'end', $3)`},
+		{"end case", "select END, ended, end_date from enrollments", `select "END", ended, end_date from enrollments`},
+		{"serial", "create table t (\n  id int(11) NOT NULL AUTO_INCREMENT,\n  n int(11)\n)", "create table t (\n  id serial NOT NULL,\n  n integer\n)"},
+		{"types", "create table t (\n  b tinyint(1) NOT NULL,\n  d datetime(6),\n  s datetime\n)", "create table t (\n  b smallint NOT NULL,\n  d timestamp(6),\n  s timestamp\n)"},
+		{"types outside create", "select 'int(11)', datetime from t", "select 'int(11)', datetime from t"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := rewritePostgres(test.query)
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRewriteSQLite(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+	}{
+		{"create", "create table t (\n  id int(11) NOT NULL AUTO_INCREMENT,\n  d datetime(6) NOT NULL,\n  s varchar(128)\n)", "create table t (\n  id int(11) NOT NULL,\n  d datetime NOT NULL,\n  s varchar(128)\n)"},
+		{"multi-row insert", "insert into enrollments(id, start, end, uuid, organization_id) values(?, ?, ?, ?, ?), (?, ?, ?, ?, ?)", "insert into enrollments(id, start, end, uuid, organization_id) values(?, ?, ?, ?, ?), (?, ?, ?, ?, ?)"},
+		{"select", "select `id`, name from organizations where id in (?, ?)", "select `id`, name from organizations where id in (?, ?)"},
+		{"delete", "delete from identities where uuid in (?)", "delete from identities where uuid in (?)"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := rewriteSQLite(test.query)
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+	for _, stmt := range portableSchema() {
+		stmt = rewriteSQLite(stmt)
+		if strings.Contains(stmt, "AUTO_INCREMENT") || strings.Contains(stmt, "datetime(") {
+			t.Errorf("statement keeps MySQL types: %s", stmt)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package shmerge
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpTimeFormat parses datetime values of mysqldump files, fractional seconds are optional
+const dumpTimeFormat = "2006-01-02 15:04:05.999999999"
+
+// dumpTable holds a table read from a mysqldump file: columns from CREATE TABLE and rows from INSERT statements
+// Values are already converted by column types: int64, time.Time (UTC), string or nil for NULL
+type dumpTable struct {
+	create  string // CREATE TABLE statement
+	columns []string
+	types   []string // lower case column types, like int(11), varchar(128), datetime(6)
+	rows    [][]interface{}
+}
+
+// column returns index of column name, -1 if there is no such column
+func (t *dumpTable) column(name string) int {
+	for i, c := range t.columns {
+		if strings.EqualFold(c, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readDump reads all tables from a mysqldump file, only CREATE TABLE and INSERT statements are used
+func readDump(path string) (map[string]*dumpTable, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDump(path, data)
+}
+
+// parseDump parses statements of a mysqldump file, name is used in errors
+func parseDump(name string, data []byte) (map[string]*dumpTable, error) {
+	tables := make(map[string]*dumpTable)
+	p := &dumpParser{data: data}
+	for {
+		stmt, line, err := p.statement()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		if stmt == nil {
+			return tables, nil
+		}
+		err = parseDumpStatement(tables, stmt)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+}
+
+// schemaTables returns empty Sorting Hat tables created by schema
+func schemaTables() map[string]*dumpTable {
+	tables, err := parseDump("schema", []byte(schema))
+	if err != nil {
+		panic(err)
+	}
+	return tables
+}
+
+// dumpParser splits mysqldump file into statements, skipping comments
+type dumpParser struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// statement returns the next statement without the trailing semicolon and its line number, nil at the end of data
+func (p *dumpParser) statement() ([]byte, int, error) {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == '\n':
+			p.line++
+			p.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == ';':
+			p.pos++
+		case bytes.HasPrefix(p.data[p.pos:], []byte("--")) || c == '#':
+			end := bytes.IndexByte(p.data[p.pos:], '\n')
+			if end < 0 {
+				p.pos = len(p.data)
+			} else {
+				p.pos += end
+			}
+		case bytes.HasPrefix(p.data[p.pos:], []byte("/*")):
+			// comments and conditional (/*!...*/) statements: SET, LOCK, ALTER TABLE ... KEYS
+			end := bytes.Index(p.data[p.pos+2:], []byte("*/"))
+			if end < 0 {
+				return nil, p.line + 1, fmt.Errorf("unterminated comment")
+			}
+			p.line += bytes.Count(p.data[p.pos:p.pos+2+end], []byte("\n"))
+			p.pos += 2 + end + 2
+		default:
+			return p.until()
+		}
+	}
+	return nil, p.line + 1, nil
+}
+
+// until returns data up to the next semicolon outside of quotes
+func (p *dumpParser) until() ([]byte, int, error) {
+	start, line := p.pos, p.line+1
+	quote := byte(0)
+	for ; p.pos < len(p.data); p.pos++ {
+		c := p.data[p.pos]
+		switch {
+		case c == '\n':
+			p.line++
+		case quote != 0 && c == '\\':
+			p.pos++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == ';':
+			p.pos++
+			return p.data[start : p.pos-1], line, nil
+		}
+	}
+	if quote != 0 {
+		return nil, line, fmt.Errorf("unterminated %c quote", quote)
+	}
+	return p.data[start:], line, nil
+}
+
+// parseDumpStatement adds a table created by CREATE TABLE or rows inserted by INSERT into tables, other statements are ignored
+func parseDumpStatement(tables map[string]*dumpTable, stmt []byte) error {
+	s := &dumpScanner{data: stmt}
+	switch {
+	case s.keywords("create", "table"):
+		s.keywords("if", "not", "exists")
+		name := s.identifier()
+		if name == "" || !s.char('(') {
+			return fmt.Errorf("cannot parse CREATE TABLE")
+		}
+		t := &dumpTable{create: string(stmt)}
+		// one column or key definition per line, like mysqldump writes them
+		for _, line := range strings.Split(string(s.data[s.pos:]), "\n") {
+			line = strings.TrimSpace(line)
+			def := &dumpScanner{data: []byte(line)}
+			col := def.identifier()
+			if col == "" || (!strings.HasPrefix(line, "`") && dumpKeyWords[strings.ToUpper(col)]) {
+				continue
+			}
+			fields := strings.Fields(string(def.data[def.pos:]))
+			if len(fields) == 0 {
+				return fmt.Errorf("cannot parse column %s of table %s", col, name)
+			}
+			t.columns = append(t.columns, col)
+			t.types = append(t.types, strings.ToLower(strings.TrimSuffix(fields[0], ",")))
+		}
+		tables[name] = t
+	case s.keywords("insert"):
+		s.keywords("ignore")
+		s.keywords("into")
+		name := s.identifier()
+		t, ok := tables[name]
+		if !ok {
+			return fmt.Errorf("INSERT into table %s not created before", name)
+		}
+		// optional list of columns, all columns are used otherwise
+		indices := make([]int, len(t.columns))
+		for i := range indices {
+			indices[i] = i
+		}
+		if s.char('(') {
+			indices = indices[:0]
+			for {
+				col := s.identifier()
+				i := t.column(col)
+				if i < 0 {
+					return fmt.Errorf("unknown column %s of table %s", col, name)
+				}
+				indices = append(indices, i)
+				if s.char(')') {
+					break
+				}
+				if !s.char(',') {
+					return fmt.Errorf("cannot parse columns of INSERT into %s", name)
+				}
+			}
+		}
+		if !s.keywords("values") {
+			return fmt.Errorf("cannot parse INSERT into %s, only VALUES are supported", name)
+		}
+		for {
+			if !s.char('(') {
+				return fmt.Errorf("cannot parse values of INSERT into %s", name)
+			}
+			row := make([]interface{}, len(t.columns))
+			for i := 0; ; i++ {
+				value, err := s.value()
+				if err != nil {
+					return fmt.Errorf("table %s row %d: %w", name, len(t.rows)+1, err)
+				}
+				if i >= len(indices) {
+					return fmt.Errorf("table %s row %d: too many values", name, len(t.rows)+1)
+				}
+				row[indices[i]], err = convertDumpValue(value, t.types[indices[i]])
+				if err != nil {
+					return fmt.Errorf("table %s row %d column %s: %w", name, len(t.rows)+1, t.columns[indices[i]], err)
+				}
+				if s.char(')') {
+					if i != len(indices)-1 {
+						return fmt.Errorf("table %s row %d: %d values given for %d columns", name, len(t.rows)+1, i+1, len(indices))
+					}
+					break
+				}
+				if !s.char(',') {
+					return fmt.Errorf("table %s row %d: cannot parse values", name, len(t.rows)+1)
+				}
+			}
+			t.rows = append(t.rows, row)
+			if !s.char(',') {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// dumpKeyWords start key and constraint definitions of CREATE TABLE
+var dumpKeyWords = map[string]bool{"PRIMARY": true, "UNIQUE": true, "KEY": true, "INDEX": true, "CONSTRAINT": true, "FOREIGN": true, "FULLTEXT": true, "CHECK": true}
+
+// baseType returns column type without size, like datetime for datetime(6)
+func baseType(typ string) string {
+	if i := strings.IndexByte(typ, '('); i >= 0 {
+		return typ[:i]
+	}
+	return typ
+}
+
+// convertDumpValue converts value parsed from INSERT (string or nil) using column type
+func convertDumpValue(value interface{}, typ string) (interface{}, error) {
+	str, ok := value.(string)
+	if !ok {
+		return nil, nil
+	}
+	switch baseType(typ) {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint":
+		return strconv.ParseInt(str, 10, 64)
+	case "datetime", "timestamp":
+		if strings.HasPrefix(str, "0000-00-00") {
+			return time.Time{}, nil
+		}
+		return time.ParseInLocation(dumpTimeFormat, str, time.UTC)
+	}
+	return str, nil
+}
+
+// dumpScanner scans tokens of a single statement
+type dumpScanner struct {
+	data []byte
+	pos  int
+}
+
+func (s *dumpScanner) skipSpace() {
+	for s.pos < len(s.data) && strings.IndexByte(" \t\r\n", s.data[s.pos]) >= 0 {
+		s.pos++
+	}
+}
+
+// keywords consumes given keywords (case insensitive) if all of them follow, returns false and consumes nothing otherwise
+func (s *dumpScanner) keywords(words ...string) bool {
+	pos := s.pos
+	for _, word := range words {
+		s.skipSpace()
+		end := s.pos + len(word)
+		if end > len(s.data) || !strings.EqualFold(string(s.data[s.pos:end]), word) || (end < len(s.data) && isWordChar(s.data[end])) {
+			s.pos = pos
+			return false
+		}
+		s.pos = end
+	}
+	return true
+}
+
+// char consumes c if it follows
+func (s *dumpScanner) char(c byte) bool {
+	s.skipSpace()
+	if s.pos < len(s.data) && s.data[s.pos] == c {
+		s.pos++
+		return true
+	}
+	return false
+}
+
+// identifier consumes a plain or backtick quoted identifier, returns "" if there is none
+func (s *dumpScanner) identifier() string {
+	s.skipSpace()
+	if s.char('`') {
+		end := bytes.IndexByte(s.data[s.pos:], '`')
+		if end < 0 {
+			return ""
+		}
+		id := string(s.data[s.pos : s.pos+end])
+		s.pos += end + 1
+		return id
+	}
+	start := s.pos
+	for s.pos < len(s.data) && isWordChar(s.data[s.pos]) {
+		s.pos++
+	}
+	return string(s.data[start:s.pos])
+}
+
+// value consumes a value: NULL (returned as nil), a number, a quoted string or a hex literal (returned as string)
+func (s *dumpScanner) value() (interface{}, error) {
+	s.skipSpace()
+	if s.keywords("null") {
+		return nil, nil
+	}
+	s.keywords("_binary")
+	s.skipSpace()
+	if s.pos >= len(s.data) {
+		return nil, fmt.Errorf("value expected")
+	}
+	switch c := s.data[s.pos]; {
+	case c == '\'' || c == '"':
+		return s.quoted(c)
+	case c == '0' && s.pos+1 < len(s.data) && (s.data[s.pos+1] == 'x' || s.data[s.pos+1] == 'X'):
+		s.pos += 2
+		start := s.pos
+		for s.pos < len(s.data) && isWordChar(s.data[s.pos]) {
+			s.pos++
+		}
+		digits := string(s.data[start:s.pos])
+		if len(digits)%2 == 1 {
+			digits = "0" + digits
+		}
+		b, err := hex.DecodeString(digits)
+		return string(b), err
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+		start := s.pos
+		s.pos++
+		for s.pos < len(s.data) && (isWordChar(s.data[s.pos]) || s.data[s.pos] == '.' || s.data[s.pos] == '-' || s.data[s.pos] == '+') {
+			s.pos++
+		}
+		return string(s.data[start:s.pos]), nil
+	}
+	end := s.pos + 20
+	if end > len(s.data) {
+		end = len(s.data)
+	}
+	return nil, fmt.Errorf("unsupported value at %q", string(s.data[s.pos:end]))
+}
+
+// quoted consumes a string quoted by q, handling backslash escapes and doubled quotes
+func (s *dumpScanner) quoted(q byte) (string, error) {
+	var b strings.Builder
+	for s.pos++; s.pos < len(s.data); s.pos++ {
+		c := s.data[s.pos]
+		switch {
+		case c == '\\' && s.pos+1 < len(s.data):
+			s.pos++
+			switch e := s.data[s.pos]; e {
+			case '0':
+				b.WriteByte(0)
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'Z':
+				b.WriteByte(26)
+			case '%', '_':
+				// kept escaped, like MySQL does
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			default:
+				b.WriteByte(e)
+			}
+		case c == q && s.pos+1 < len(s.data) && s.data[s.pos+1] == q:
+			b.WriteByte(q)
+			s.pos++
+		case c == q:
+			s.pos++
+			return b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,142 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dumpTestTable creates table t the way mysqldump writes it
+const dumpTestTable = "CREATE TABLE `t` (\n" +
+	"  `id` int(11) NOT NULL AUTO_INCREMENT,\n" +
+	"  `s` varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,\n" +
+	"  `d` datetime(6) DEFAULT NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  UNIQUE KEY `_s_unique` (`s`)\n" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;\n"
+
+func TestParseDump(t *testing.T) {
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name   string
+		insert string
+		rows   [][]interface{}
+	}{
+		{"plain", "INSERT INTO `t` VALUES (1,'a','2020-01-02 03:04:05');", [][]interface{}{{int64(1), "a", date}}},
+		{"escapes", `INSERT INTO t VALUES (1,'it\'s ''x'' \\ \"q\"\n\r\t\0\Z\%\_','2020-01-02 03:04:05');`, [][]interface{}{{int64(1), "it's 'x' \\ \"q\"\n\r\t\x00\x1a\\%\\_", date}}},
+		{"double quoted", `INSERT INTO t VALUES (1,"a""b\"c;",NULL);`, [][]interface{}{{int64(1), `a"b"c;`, nil}}},
+		{"null", "INSERT INTO t VALUES (1,NULL,null);", [][]interface{}{{int64(1), nil, nil}}},
+		{"binary", "INSERT INTO t VALUES (1,_binary 'a\\'b',NULL);", [][]interface{}{{int64(1), "a'b", nil}}},
+		{"hex", "INSERT INTO t VALUES (2,0x4142,NULL),(3,0X414,NULL);", [][]interface{}{{int64(2), "AB", nil}, {int64(3), "\x04\x14", nil}}},
+		{"negative", "INSERT INTO t VALUES (-1,'a',NULL);", [][]interface{}{{int64(-1), "a", nil}}},
+		{"column list", "INSERT INTO `t` (`s`, id) VALUES ('a',1);", [][]interface{}{{int64(1), "a", nil}}},
+		{"multi row", "INSERT INTO t VALUES (1,'a',NULL), (2,'b',NULL),\n(3,'c',NULL);\nINSERT INTO t VALUES (4,'d',NULL);", [][]interface{}{{int64(1), "a", nil}, {int64(2), "b", nil}, {int64(3), "c", nil}, {int64(4), "d", nil}}},
+		{"fraction", "INSERT INTO t VALUES (1,'a','2020-01-02 03:04:05.123456'),(2,'b','2020-01-02 03:04:05.000000');", [][]interface{}{{int64(1), "a", date.Add(123456 * time.Microsecond)}, {int64(2), "b", date}}},
+		{"zero date", "INSERT INTO t VALUES (1,'a','0000-00-00 00:00:00');", [][]interface{}{{int64(1), "a", time.Time{}}}},
+		{"comments", "/*!40101 SET NAMES utf8mb4 */;\n-- comment; with semicolon\n# another one\n/* block\n comment */\nLOCK TABLES `t` WRITE;\n/*!40000 ALTER TABLE `t` DISABLE KEYS */;\nINSERT INTO t VALUES (1,'-- not a comment /* */',NULL);\nUNLOCK TABLES;", [][]interface{}{{int64(1), "-- not a comment /* */", nil}}},
+		{"ignore", "INSERT IGNORE INTO t VALUES (1,'a',NULL);", [][]interface{}{{int64(1), "a", nil}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tables, err := parseDump("test", []byte(dumpTestTable+test.insert))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tab := tables["t"]
+			if tab == nil {
+				t.Fatal("table t not parsed")
+			}
+			if !reflect.DeepEqual(tab.columns, []string{"id", "s", "d"}) || !reflect.DeepEqual(tab.types, []string{"int(11)", "varchar(128)", "datetime(6)"}) {
+				t.Fatalf("got columns %v of types %v", tab.columns, tab.types)
+			}
+			if !reflect.DeepEqual(tab.rows, test.rows) {
+				t.Fatalf("got rows %#v, want %#v", tab.rows, test.rows)
+			}
+		})
+	}
+}
+
+func TestParseDumpErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"unterminated string", dumpTestTable + "INSERT INTO t VALUES (1,'a", "test:8: unterminated ' quote"},
+		{"unterminated comment", dumpTestTable + "/* comment", "test:8: unterminated comment"},
+		{"no table", "INSERT INTO t VALUES (1,'a',NULL);", "test:1: INSERT into table t not created before"},
+		{"unknown column", dumpTestTable + "INSERT INTO t (x) VALUES (1);", "test:8: unknown column x of table t"},
+		{"too many values", dumpTestTable + "INSERT INTO t VALUES (1,'a',NULL,2);", "test:8: table t row 1: too many values"},
+		{"too few values", dumpTestTable + "INSERT INTO t VALUES (1,'a');", "test:8: table t row 1: 2 values given for 3 columns"},
+		{"bad number", dumpTestTable + "INSERT INTO t VALUES ('x','a',NULL);", `test:8: table t row 1 column id: strconv.ParseInt: parsing "x": invalid syntax`},
+		{"select", dumpTestTable + "INSERT INTO t SELECT 1;", "test:8: cannot parse INSERT into t, only VALUES are supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseDump("test", []byte(test.data))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
+
+func TestWriteDumpRoundTrip(t *testing.T) {
+	tables, err := parseDump("test", []byte(dumpTestTable))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab := tables["t"]
+	tab.rows = [][]interface{}{
+		{int64(1), "it's \"q\" \\ \n\r\t\x00\x1a ; -- /* */ zażółć", time.Date(2020, 1, 2, 3, 4, 5, 123456000, time.UTC)},
+		{int64(2), "", time.Time{}},
+		{int64(3), nil, nil},
+	}
+	var buf bytes.Buffer
+	err = writeDump(&buf, tables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := parseDump("written", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read["t"] == nil || !reflect.DeepEqual(read["t"].rows, tab.rows) {
+		t.Fatalf("written dump:\n%s\nread back as %#v", buf.String(), read["t"])
+	}
+}
+
+// TestCreateDumpRoundTrip checks a database written by CreateDump reads back the same by OpenDump:
+// merging the written database alone writes it again byte for byte
+func TestCreateDumpRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	merge := func(path string, inputs ...*sql.DB) []byte {
+		err := testMerger().Merge(context.Background(), inputs, CreateDump(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	written := merge(filepath.Join(dir, "merged.sql"), openTestDump(t, testBase), openTestDump(t, testCased))
+	db, err := OpenDump(filepath.Join(dir, "merged.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again := merge(filepath.Join(dir, "again.sql"), db)
+	if !bytes.Equal(written, again) {
+		t.Fatalf("database written by CreateDump changed when read back:\n%s\n\n%s", written, again)
+	}
+	if !strings.Contains(string(written), "'User Three'") {
+		t.Fatalf("merged rows missing:\n%s", written)
+	}
+}
@@ -0,0 +1,310 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dumpDelete and dumpInsert match statements supported by dump databases created by CreateDump
+var (
+	dumpDelete = regexp.MustCompile(`(?is)^\s*delete\s+from\s+(\w+)\s*$`)
+	dumpInsert = regexp.MustCompile(`(?is)^\s*insert\s+into\s+(\w+)\s*\(([^)]*)\)\s*values([\s(),?]*)$`)
+)
+
+// dumpQuery matches queries supported by dump databases: whole tables, optionally only rows of given uuids, and counting rows
+var dumpQuery = regexp.MustCompile(`(?is)^\s*select\s+(.+?)\s+from\s+(\w+)(?:\s+where\s+uuid\s+in\s*\(([?,\s]*)\))?\s*$`)
+
+// OpenDump reads a mysqldump file (like dump_staging.sql) and returns it as a read-only database usable as an input
+// Only CREATE TABLE and INSERT statements are used, so no database server is needed to merge dumps
+// It supports the queries used to read inputs: Merge, MergePlan and WriteBack (dry run) work, writing into it fails with ErrDumpReadOnly
+func OpenDump(path string) (*sql.DB, error) {
+	tables, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(dumpConnector{db: &dumpDB{tables: tables}}), nil
+}
+
+// CreateDump returns an empty database holding all Sorting Hat tables, usable as the output database
+// Every committed transaction (re)writes path as a mysqldump compatible SQL file, see writeDump
+// Only deleting all rows of a table and inserting rows are supported, so it works with a plain merge (no upsert, incremental merge or ID mapping table)
+func CreateDump(path string) *sql.DB {
+	return sql.OpenDB(dumpConnector{db: &dumpDB{path: path, tables: schemaTables()}})
+}
+
+// dumpDB holds tables of a dump, committed transactions replace tables and write them into path
+type dumpDB struct {
+	path   string // empty for read-only dumps
+	mu     sync.Mutex
+	tables map[string]*dumpTable
+}
+
+// current returns committed tables, they are never modified
+func (d *dumpDB) current() map[string]*dumpTable {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tables
+}
+
+// commit writes tables into d.path and makes them current
+func (d *dumpDB) commit(tables map[string]*dumpTable) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	err := writeDumpFile(d.path, tables)
+	if err != nil {
+		return err
+	}
+	d.tables = tables
+	return nil
+}
+
+// cloneDumpTables returns copy of tables that can be modified without changing tables
+func cloneDumpTables(tables map[string]*dumpTable) map[string]*dumpTable {
+	clone := make(map[string]*dumpTable, len(tables))
+	for name, t := range tables {
+		c := *t
+		// appending to rows copies them
+		c.rows = c.rows[:len(c.rows):len(c.rows)]
+		clone[name] = &c
+	}
+	return clone
+}
+
+// dumpConnector returns connections to a dump
+type dumpConnector struct {
+	db *dumpDB
+}
+
+func (c dumpConnector) Connect(context.Context) (driver.Conn, error) {
+	return &dumpConn{db: c.db}, nil
+}
+
+func (c dumpConnector) Driver() driver.Driver {
+	return dumpDriver{}
+}
+
+// dumpDriver opens dump files by path, read-only
+type dumpDriver struct{}
+
+func (dumpDriver) Open(path string) (driver.Conn, error) {
+	tables, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+	return &dumpConn{db: &dumpDB{tables: tables}}, nil
+}
+
+// dumpConn reads committed tables, or tables of its transaction when it is in progress
+type dumpConn struct {
+	db *dumpDB
+	tx *dumpTx
+}
+
+func (c *dumpConn) Prepare(query string) (driver.Stmt, error) {
+	return &dumpStmt{conn: c, query: query}, nil
+}
+
+func (c *dumpConn) Close() error {
+	return nil
+}
+
+func (c *dumpConn) Begin() (driver.Tx, error) {
+	if c.db.path == "" {
+		return nil, ErrDumpReadOnly
+	}
+	c.tx = &dumpTx{conn: c, tables: cloneDumpTables(c.db.current())}
+	return c.tx, nil
+}
+
+// tables returns tables seen by the connection
+func (c *dumpConn) tables() map[string]*dumpTable {
+	if c.tx != nil {
+		return c.tx.tables
+	}
+	return c.db.current()
+}
+
+// dumpTx changes a copy of tables, commit writes them into the dump file
+type dumpTx struct {
+	conn   *dumpConn
+	tables map[string]*dumpTable
+}
+
+func (tx *dumpTx) Commit() error {
+	tx.conn.tx = nil
+	return tx.conn.db.commit(tx.tables)
+}
+
+func (tx *dumpTx) Rollback() error {
+	tx.conn.tx = nil
+	return nil
+}
+
+type dumpStmt struct {
+	conn  *dumpConn
+	query string
+}
+
+func (s *dumpStmt) Close() error {
+	return nil
+}
+
+func (s *dumpStmt) NumInput() int {
+	return -1
+}
+
+func (s *dumpStmt) Exec(args []driver.Value) (driver.Result, error) {
+	c := s.conn
+	if c.db.path == "" {
+		return nil, ErrDumpReadOnly
+	}
+	if c.tx != nil {
+		return execDump(c.tx.tables, s.query, args)
+	}
+	// outside of a transaction every statement is committed
+	tables := cloneDumpTables(c.db.current())
+	res, err := execDump(tables, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return res, c.db.commit(tables)
+}
+
+// execDump runs a statement changing tables: delete of all rows or insert using placeholders, like writeTables does
+func execDump(tables map[string]*dumpTable, query string, args []driver.Value) (driver.Result, error) {
+	if m := dumpDelete.FindStringSubmatch(query); m != nil {
+		t, ok := tables[m[1]]
+		if !ok {
+			return nil, fmt.Errorf("table %s not found in dump", m[1])
+		}
+		n := len(t.rows)
+		t.rows = nil
+		return driver.RowsAffected(n), nil
+	}
+	m := dumpInsert.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("statement not supported by dump databases: %s", query)
+	}
+	t, ok := tables[m[1]]
+	if !ok {
+		return nil, fmt.Errorf("table %s not found in dump", m[1])
+	}
+	var indices []int
+	for _, col := range strings.Split(m[2], ",") {
+		col = strings.Trim(strings.TrimSpace(col), "`")
+		i := t.column(col)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown column %s of table %s", col, m[1])
+		}
+		indices = append(indices, i)
+	}
+	if len(args)%len(indices) != 0 || strings.Count(m[3], "?") != len(args) {
+		return nil, fmt.Errorf("%d values given for %d columns of table %s", len(args), len(indices), m[1])
+	}
+	for from := 0; from < len(args); from += len(indices) {
+		row := make([]interface{}, len(t.columns))
+		for i, index := range indices {
+			row[index] = dumpRowValue(args[from+i])
+		}
+		t.rows = append(t.rows, row)
+	}
+	return driver.RowsAffected(len(args) / len(indices)), nil
+}
+
+// dumpRowValue converts value of a statement argument into a value stored in a dump table, like values read from dump files
+func dumpRowValue(v driver.Value) interface{} {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC()
+	}
+	return v
+}
+
+func (s *dumpStmt) Query(args []driver.Value) (driver.Rows, error) {
+	m := dumpQuery.FindStringSubmatch(s.query)
+	if m == nil {
+		return nil, fmt.Errorf("query not supported by dump databases: %s", s.query)
+	}
+	t, ok := s.conn.tables()[m[2]]
+	if !ok {
+		return nil, fmt.Errorf("table %s not found in dump", m[2])
+	}
+	rows := t.rows
+	if m[3] != "" {
+		uuid := t.column("uuid")
+		if uuid < 0 {
+			return nil, fmt.Errorf("table %s has no uuid column", m[2])
+		}
+		uuids := make(map[interface{}]struct{})
+		for _, arg := range args {
+			uuids[arg] = struct{}{}
+		}
+		rows = nil
+		for _, row := range t.rows {
+			if _, ok := uuids[row[uuid]]; ok {
+				rows = append(rows, row)
+			}
+		}
+	}
+	if strings.EqualFold(strings.Join(strings.Fields(m[1]), ""), "count(*)") {
+		return &dumpRows{columns: []string{"count(*)"}, rows: [][]interface{}{{int64(len(rows))}}}, nil
+	}
+	var columns []string
+	var indices []int
+	for _, col := range strings.Split(m[1], ",") {
+		col = strings.Trim(strings.TrimSpace(col), "`")
+		i := t.column(col)
+		if i < 0 {
+			return nil, fmt.Errorf("unknown column %s of table %s", col, m[2])
+		}
+		columns = append(columns, col)
+		indices = append(indices, i)
+	}
+	return &dumpRows{columns: columns, indices: indices, rows: rows}, nil
+}
+
+// dumpRows returns columns at indices of rows, or whole rows when indices is nil
+type dumpRows struct {
+	columns []string
+	indices []int
+	rows    [][]interface{}
+	pos     int
+}
+
+func (r *dumpRows) Columns() []string {
+	return r.columns
+}
+
+func (r *dumpRows) Close() error {
+	return nil
+}
+
+func (r *dumpRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	row := r.rows[r.pos]
+	r.pos++
+	for i := range dest {
+		if r.indices == nil {
+			dest[i] = row[i]
+		} else {
+			dest[i] = row[r.indices[i]]
+		}
+	}
+	return nil
+}
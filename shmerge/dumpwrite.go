@@ -0,0 +1,198 @@
+package shmerge
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dumpInsertSize is the maximum size of a single extended INSERT statement written into dump files
+const dumpInsertSize = 1 << 20
+
+const dumpHeader = `-- merge-sh-dbs dump of a merged Sorting Hat database, compatible with mysqldump
+-- ------------------------------------------------------
+
+/*!40101 SET @OLD_CHARACTER_SET_CLIENT=@@CHARACTER_SET_CLIENT */;
+/*!40101 SET @OLD_CHARACTER_SET_RESULTS=@@CHARACTER_SET_RESULTS */;
+/*!40101 SET @OLD_COLLATION_CONNECTION=@@COLLATION_CONNECTION */;
+/*!40101 SET NAMES utf8mb4 */;
+/*!40103 SET @OLD_TIME_ZONE=@@TIME_ZONE */;
+/*!40103 SET TIME_ZONE='+00:00' */;
+/*!40014 SET @OLD_UNIQUE_CHECKS=@@UNIQUE_CHECKS, UNIQUE_CHECKS=0 */;
+/*!40014 SET @OLD_FOREIGN_KEY_CHECKS=@@FOREIGN_KEY_CHECKS, FOREIGN_KEY_CHECKS=0 */;
+/*!40101 SET @OLD_SQL_MODE=@@SQL_MODE, SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;
+/*!40111 SET @OLD_SQL_NOTES=@@SQL_NOTES, SQL_NOTES=0 */;
+`
+
+const dumpFooter = `/*!40103 SET TIME_ZONE=@OLD_TIME_ZONE */;
+
+/*!40101 SET SQL_MODE=@OLD_SQL_MODE */;
+/*!40014 SET FOREIGN_KEY_CHECKS=@OLD_FOREIGN_KEY_CHECKS */;
+/*!40014 SET UNIQUE_CHECKS=@OLD_UNIQUE_CHECKS */;
+/*!40101 SET CHARACTER_SET_CLIENT=@OLD_CHARACTER_SET_CLIENT */;
+/*!40101 SET CHARACTER_SET_RESULTS=@OLD_CHARACTER_SET_RESULTS */;
+/*!40101 SET COLLATION_CONNECTION=@OLD_COLLATION_CONNECTION */;
+/*!40111 SET SQL_NOTES=@OLD_SQL_NOTES */;
+
+-- Dump completed
+`
+
+// writeDumpFile writes tables into path using writeDump, path is replaced only when the whole file was written
+func writeDumpFile(path string, tables map[string]*dumpTable) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = writeDump(w, tables)
+	if err == nil {
+		err = w.Flush()
+	}
+	cErr := f.Close()
+	if err == nil {
+		err = cErr
+	}
+	if err == nil {
+		// temporary files are private, dumps are not
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// writeDump writes tables in names order as a mysqldump compatible SQL file, like dump_struct.sql plus data:
+// DROP and CREATE TABLE followed by extended INSERT statements, utf8mb4 names and foreign key checks disabled while loading
+func writeDump(w io.Writer, tables map[string]*dumpTable) error {
+	var names []string
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	_, err := io.WriteString(w, dumpHeader)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		t := tables[name]
+		_, err = fmt.Fprintf(
+			w,
+			"\n--\n-- Table structure for table `%s`\n--\n\nDROP TABLE IF EXISTS `%s`;\n"+
+				"/*!40101 SET @saved_cs_client     = @@character_set_client */;\n/*!40101 SET character_set_client = utf8 */;\n"+
+				"%s;\n/*!40101 SET character_set_client = @saved_cs_client */;\n",
+			name, name, t.create,
+		)
+		if err != nil {
+			return err
+		}
+		if len(t.rows) == 0 {
+			continue
+		}
+		_, err = fmt.Fprintf(w, "\n--\n-- Dumping data for table `%s`\n--\n\nLOCK TABLES `%s` WRITE;\n/*!40000 ALTER TABLE `%s` DISABLE KEYS */;\n", name, name, name)
+		if err != nil {
+			return err
+		}
+		err = writeDumpInserts(w, name, t)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "/*!40000 ALTER TABLE `%s` ENABLE KEYS */;\nUNLOCK TABLES;\n", name)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "\n"+dumpFooter)
+	return err
+}
+
+// writeDumpInserts writes rows of table t as extended INSERT statements of at most dumpInsertSize bytes (unless a single row is bigger)
+func writeDumpInserts(w io.Writer, name string, t *dumpTable) error {
+	prefix := "INSERT INTO `" + name + "` VALUES "
+	var stmt strings.Builder
+	for _, row := range t.rows {
+		values := make([]string, len(row))
+		for i, v := range row {
+			values[i] = dumpValue(v, t.types[i])
+		}
+		tuple := "(" + strings.Join(values, ",") + ")"
+		if stmt.Len() > 0 && stmt.Len()+len(tuple)+2 > dumpInsertSize {
+			_, err := io.WriteString(w, stmt.String()+";\n")
+			if err != nil {
+				return err
+			}
+			stmt.Reset()
+		}
+		if stmt.Len() == 0 {
+			stmt.WriteString(prefix)
+		} else {
+			stmt.WriteByte(',')
+		}
+		stmt.WriteString(tuple)
+	}
+	_, err := io.WriteString(w, stmt.String()+";\n")
+	return err
+}
+
+// dumpValue formats a value of a column of type typ as a MySQL literal
+func dumpValue(v interface{}, typ string) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case time.Time:
+		// datetime(n) columns are written with n fractional digits, like mysqldump does
+		layout := "2006-01-02 15:04:05"
+		if i := strings.IndexByte(typ, '('); i >= 0 {
+			n, _ := strconv.Atoi(strings.TrimSuffix(typ[i+1:], ")"))
+			if n > 0 {
+				layout += "." + strings.Repeat("0", n)
+			}
+		}
+		return "'" + v.UTC().Format(layout) + "'"
+	case string:
+		return quoteDumpString(v)
+	}
+	return quoteDumpString(fmt.Sprintf("%v", v))
+}
+
+// quoteDumpString quotes s escaping characters like mysqldump (mysql_real_escape_string) does
+func quoteDumpString(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\'':
+			b.WriteString(`\'`)
+		case '"':
+			b.WriteString(`\"`)
+		case 26:
+			b.WriteString(`\Z`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
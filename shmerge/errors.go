@@ -0,0 +1,62 @@
+package shmerge
+
+import (
+	"errors"
+)
+
+const (
+	// OutputDB is the database number used in errors related to the output database
+	OutputDB = -1
+	// BaseDB is the database number used in errors related to the base (common ancestor) database
+	BaseDB = 0
+)
+
+var (
+	// ErrUnknownOrganization - row references an organization ID that doesn't exist in its database
+	ErrUnknownOrganization = errors.New("cannot map organization ID")
+	// ErrMissingRow - row expected in a merged table is missing
+	ErrMissingRow = errors.New("missing row")
+	// ErrConflict - rows differ in a field having the "fail" conflict resolution policy
+	ErrConflict = errors.New("conflict not allowed by policy")
+	// ErrAborted - operator quit the interactive conflict resolution
+	ErrAborted = errors.New("merge aborted by operator")
+	// ErrInputsChanged - input databases changed since the conflicts file was written
+	ErrInputsChanged = errors.New("database changed since conflicts file was written")
+	// ErrNotInConflictsFile - conflict is missing in the applied conflicts file
+	ErrNotInConflictsFile = errors.New("conflict not found in conflicts file")
+	// ErrDumpReadOnly - database read from a mysqldump file (see OpenDump) cannot be written
+	ErrDumpReadOnly = errors.New("database read from a dump file is read-only")
+)
+
+// Error holds details about a failed merge step
+type Error struct {
+	Table string // table being merged, empty if error is not related to a single table
+	DB    int    // 1-based input database number, OutputDB or BaseDB
+	Key   string // row key, empty if error is not related to a single row
+	Op    string // operation that failed: query, scan, insert, delete, ...
+	Err   error
+}
+
+func (e *Error) Error() string {
+	s := e.Op + " (" + dbName(e.DB) + ")"
+	if e.Table != "" {
+		s = e.Table + ": " + s
+	}
+	if e.Key != "" {
+		s += " key " + e.Key
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrapError returns nil if err is nil, otherwise err wrapped into *Error
+func wrapError(err error, table string, db int, op, key string) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Table: table, DB: db, Key: key, Op: op, Err: err}
+}
@@ -0,0 +1,67 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testBase is a small Sorting Hat database, used as the base and as an input by tests
+const testBase = `
+INSERT INTO countries VALUES ('PL','Poland','POL');
+INSERT INTO organizations VALUES (1,'CNCF'),(2,'Google');
+INSERT INTO domains_organizations VALUES (1,'cncf.io',1,1),(2,'google.com',1,2);
+INSERT INTO matching_blacklist VALUES ('root');
+INSERT INTO uidentities VALUES ('u1','2020-01-01 00:00:00.000000'),('u2','2020-01-01 00:00:00.000000');
+INSERT INTO profiles VALUES ('u1','User One',NULL,NULL,NULL,0,'PL'),('u2','User Two','two@x.com',NULL,NULL,0,NULL);
+INSERT INTO identities VALUES ('i1','User One',NULL,'u1','github','u1','2020-01-01 00:00:00.000000'),('i2','User Two','two@x.com','u2','git','u2','2020-01-01 00:00:00.000000');
+INSERT INTO enrollments VALUES (1,'1900-01-01 00:00:00','2100-01-01 00:00:00','u1',1),(2,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',2);
+`
+
+// testChanged holds the same rows as testBase using other IDs, only google.com is no longer a top domain
+const testChanged = `
+INSERT INTO countries VALUES ('PL','Poland','POL');
+INSERT INTO organizations VALUES (5,'Google'),(6,'CNCF');
+INSERT INTO domains_organizations VALUES (7,'cncf.io',1,6),(8,'google.com',0,5);
+INSERT INTO matching_blacklist VALUES ('root');
+INSERT INTO uidentities VALUES ('u1','2020-01-01 00:00:00.000000'),('u2','2020-01-01 00:00:00.000000');
+INSERT INTO profiles VALUES ('u1','User One',NULL,NULL,NULL,0,'PL'),('u2','User Two','two@x.com',NULL,NULL,0,NULL);
+INSERT INTO identities VALUES ('i1','User One',NULL,'u1','github','u1','2020-01-01 00:00:00.000000'),('i2','User Two','two@x.com','u2','git','u2','2020-01-01 00:00:00.000000');
+INSERT INTO enrollments VALUES (10,'1900-01-01 00:00:00','2100-01-01 00:00:00','u1',6),(11,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',5);
+`
+
+// openTestDump returns a read-only database holding all Sorting Hat tables and rows inserted by data
+func openTestDump(t *testing.T, data string) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.sql")
+	err := ioutil.WriteFile(path, []byte(schema+data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDump(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testMerger returns a Merger without any output
+func testMerger() *Merger {
+	return &Merger{}
+}
+
+// loadTest reads all tables of dbs, they are numbered like inputs
+func loadTest(t *testing.T, dbs ...*sql.DB) []*snapshot {
+	t.Helper()
+	var dbNums []int
+	for i := range dbs {
+		dbNums = append(dbNums, i+1)
+	}
+	snaps, err := testMerger().loadDatabases(context.Background(), dbs, dbNums, loadTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snaps
+}
@@ -0,0 +1,63 @@
+package shmerge
+
+import (
+	"context"
+	"sync"
+)
+
+// group runs functions in goroutines, at most limit of them at once
+// The first error cancels the group context and is returned by wait, just like golang.org/x/sync/errgroup does
+type group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+}
+
+// newGroup returns a group running at most limit functions at once (no limit if limit < 1)
+func newGroup(ctx context.Context, limit int) *group {
+	g := &group{}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	if limit > 0 {
+		g.sem = make(chan struct{}, limit)
+	}
+	return g
+}
+
+// do runs f in a goroutine, waiting for a free slot first, f receives the group context
+func (g *group) do(f func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if g.sem != nil {
+			select {
+			case g.sem <- struct{}{}:
+				defer func() { <-g.sem }()
+			case <-g.ctx.Done():
+				g.fail(g.ctx.Err())
+				return
+			}
+		}
+		err := f(g.ctx)
+		if err != nil {
+			g.fail(err)
+		}
+	}()
+}
+
+// fail records the first error and cancels the group context
+func (g *group) fail(err error) {
+	g.once.Do(func() {
+		g.err = err
+		g.cancel()
+	})
+}
+
+// wait waits for all functions and returns the first error
+func (g *group) wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,114 @@
+package shmerge
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitGroup returns the error of g.wait, failing the test if it doesn't return in time
+func waitGroup(t *testing.T, g *group) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- g.wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("group functions did not return")
+		return nil
+	}
+}
+
+func TestGroupLimit(t *testing.T) {
+	var running, max, ran int32
+	g := newGroup(context.Background(), 3)
+	for i := 0; i < 12; i++ {
+		g.do(func(context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			atomic.AddInt32(&ran, 1)
+			return nil
+		})
+	}
+	err := waitGroup(t, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ran != 12 || max > 3 {
+		t.Fatalf("ran %d functions, %d at once, want 12, at most 3", ran, max)
+	}
+}
+
+func TestGroupNoLimit(t *testing.T) {
+	// every function waits for all of them to start, so they must run at once
+	var started sync.WaitGroup
+	started.Add(5)
+	g := newGroup(context.Background(), 0)
+	for i := 0; i < 5; i++ {
+		g.do(func(context.Context) error {
+			started.Done()
+			started.Wait()
+			return nil
+		})
+	}
+	err := waitGroup(t, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupFirstErrorCancels(t *testing.T) {
+	errFirst := errors.New("first")
+	var canceled int32
+	// the failing function waits for the others to start, they only return when the group context is canceled
+	var started sync.WaitGroup
+	started.Add(3)
+	g := newGroup(context.Background(), 4)
+	for i := 0; i < 3; i++ {
+		g.do(func(ctx context.Context) error {
+			started.Done()
+			<-ctx.Done()
+			atomic.AddInt32(&canceled, 1)
+			return ctx.Err()
+		})
+	}
+	g.do(func(context.Context) error {
+		started.Wait()
+		return errFirst
+	})
+	err := waitGroup(t, g)
+	if err != errFirst || canceled != 3 {
+		t.Fatalf("got error %v and %d canceled functions, want %v and 3", err, canceled, errFirst)
+	}
+	if g.ctx.Err() == nil {
+		t.Fatal("group context not canceled")
+	}
+}
+
+func TestGroupCanceledWhileWaiting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := newGroup(ctx, 1)
+	// the only slot is taken and never freed, so the function can only return because of the canceled context
+	g.sem <- struct{}{}
+	var ran int32
+	g.do(func(context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	})
+	cancel()
+	err := waitGroup(t, g)
+	if !errors.Is(err, context.Canceled) || ran != 0 {
+		t.Fatalf("got error %v and %d functions run, want %v and none", err, ran, context.Canceled)
+	}
+}
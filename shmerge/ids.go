@@ -0,0 +1,178 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IDMapping maps an ID from an input database into the merged database
+type IDMapping struct {
+	DB    int    // 1-based input database number
+	Table string // organizations, domains_organizations or enrollments
+	OldID int64
+	NewID int64
+}
+
+// mergedIDs holds organization, domain and enrollment IDs allocated for the merged database
+type mergedIDs struct {
+	orgs        map[string]int64        // lower case organization name -> ID
+	domains     map[string]int64        // lower case domain -> ID
+	enrollments map[EnrollmentKey]int64 // (uuid, start, end) -> ID
+}
+
+// allocateIDs allocates IDs of merged organizations and domains in names order and enrollment IDs in keys order
+// When primary is set its organization and domain IDs (and enrollment IDs if keepEnrollments is set) are kept,
+// other rows get IDs greater than any ID used in primary
+func allocateIDs(s, primary *snapshot, keepEnrollments bool) *mergedIDs {
+	orgIDs := make(map[string]int64)
+	maxOrgID := int64(0)
+	domainIDs := make(map[string]int64)
+	maxDomainID := int64(0)
+	if primary != nil {
+		for id, name := range primary.orgs {
+			// names differing only in case: the lowest ID is kept, just like when loading
+			lName := strings.ToLower(name)
+			prevID, ok := orgIDs[lName]
+			if !ok || id < prevID {
+				orgIDs[lName] = id
+			}
+			if id > maxOrgID {
+				maxOrgID = id
+			}
+		}
+		for lDomain, do := range primary.domains {
+			domainIDs[lDomain] = do.ID
+			if do.ID > maxDomainID {
+				maxDomainID = do.ID
+			}
+		}
+	}
+	var keys []string
+	for lName := range s.orgNames {
+		keys = append(keys, lName)
+	}
+	ids := &mergedIDs{orgs: assignIDs(keys, orgIDs, maxOrgID)}
+	keys = nil
+	for lDomain := range s.domains {
+		keys = append(keys, lDomain)
+	}
+	ids.domains = assignIDs(keys, domainIDs, maxDomainID)
+	ids.enrollments = make(map[EnrollmentKey]int64)
+	keptEnrollments := make(map[EnrollmentKey]int64)
+	maxEnrollmentID := int64(0)
+	if primary != nil && keepEnrollments {
+		for k, e := range primary.enrollments {
+			keptEnrollments[k] = e.ID
+			if e.ID > maxEnrollmentID {
+				maxEnrollmentID = e.ID
+			}
+		}
+	}
+	for _, k := range sortedEnrollmentKeys(s.enrollments) {
+		id, ok := keptEnrollments[k]
+		if !ok {
+			maxEnrollmentID++
+			id = maxEnrollmentID
+		}
+		ids.enrollments[k] = id
+	}
+	return ids
+}
+
+// assignIDs returns IDs for keys: kept IDs if they have them, subsequent IDs after maxID (in keys order) otherwise
+func assignIDs(keys []string, kept map[string]int64, maxID int64) map[string]int64 {
+	sort.Strings(keys)
+	ids := make(map[string]int64)
+	for _, k := range keys {
+		id, ok := kept[k]
+		if !ok {
+			maxID++
+			id = maxID
+		}
+		ids[k] = id
+	}
+	return ids
+}
+
+// mappings returns mapping of organization, domain and enrollment IDs from every input in srcs (as read) into merged IDs
+// Rows not present in the merged database (deleted in a three-way merge) are skipped
+func (ids *mergedIDs) mappings(srcs []*snapshot) []IDMapping {
+	var mappings []IDMapping
+	for i, s := range srcs {
+		var orgs []IDMapping
+		for id, name := range s.orgs {
+			newID, ok := ids.orgs[strings.ToLower(name)]
+			if ok {
+				orgs = append(orgs, IDMapping{DB: i + 1, Table: "organizations", OldID: id, NewID: newID})
+			}
+		}
+		var domains []IDMapping
+		for lDomain, do := range s.domains {
+			newID, ok := ids.domains[lDomain]
+			if ok {
+				domains = append(domains, IDMapping{DB: i + 1, Table: "domains_organizations", OldID: do.ID, NewID: newID})
+			}
+		}
+		var enrollments []IDMapping
+		for k, e := range s.enrollments {
+			newID, ok := ids.enrollments[k]
+			if ok {
+				enrollments = append(enrollments, IDMapping{DB: i + 1, Table: "enrollments", OldID: e.ID, NewID: newID})
+			}
+		}
+		for _, ms := range [][]IDMapping{orgs, domains, enrollments} {
+			sort.Slice(ms, func(i, j int) bool { return ms[i].OldID < ms[j].OldID })
+			mappings = append(mappings, ms...)
+		}
+	}
+	return mappings
+}
+
+// WriteIDMapCSV writes ID mappings to w as CSV with a header, columns are: db, table, old_id, new_id
+func WriteIDMapCSV(w io.Writer, mappings []IDMapping) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"db", "table", "old_id", "new_id"})
+	if err != nil {
+		return err
+	}
+	for _, mp := range mappings {
+		err = cw.Write([]string{strconv.Itoa(mp.DB), mp.Table, strconv.FormatInt(mp.OldID, 10), strconv.FormatInt(mp.NewID, 10)})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// createIDMapTable creates table receiving ID mappings in the output database, unless it exists
+// It must be called outside of the write transaction, MySQL commits transactions on create table
+func createIDMapTable(ctx context.Context, db *sql.DB, table string) error {
+	_, err := db.ExecContext(
+		ctx,
+		"create table if not exists "+table+"(db int not null, table_name varchar(64) not null, old_id bigint not null, new_id bigint not null, primary key(db, table_name, old_id))",
+	)
+	return wrapError(err, table, OutputDB, "create table", "")
+}
+
+// writeIDMap replaces contents of the ID mappings table using tx
+func (m *Merger) writeIDMap(ctx context.Context, tx *sql.Tx, table string, mappings []IDMapping) error {
+	_, err := tx.ExecContext(ctx, "delete from "+table)
+	if err != nil {
+		return wrapError(err, table, OutputDB, "delete", "")
+	}
+	ins := m.newInserter(ctx, tx, table, "db", "table_name", "old_id", "new_id")
+	for _, mp := range mappings {
+		err := ins.add(fmt.Sprintf("%d %s %d", mp.DB, mp.Table, mp.OldID), mp.DB, mp.Table, mp.OldID, mp.NewID)
+		if err != nil {
+			return err
+		}
+	}
+	return ins.flush()
+}
@@ -0,0 +1,95 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPreserveIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		inputs  []string
+		orgs    map[string]int64
+		domains map[string]int64
+	}{
+		{
+			name:    "new rows after the highest ID",
+			inputs:  []string{testBase, testCased},
+			orgs:    map[string]int64{"cncf": 1, "google": 2, "microsoft": 3},
+			domains: map[string]int64{"cncf.io": 1, "google.com": 2, "microsoft.com": 3},
+		},
+		{
+			name:    "with base, rows changed only in the 2nd input",
+			base:    testBase,
+			inputs:  []string{testBase, testChanged},
+			orgs:    map[string]int64{"cncf": 1, "google": 2},
+			domains: map[string]int64{"cncf.io": 1, "google.com": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testMerger()
+			m.PreserveIDs = true
+			if tt.base != "" {
+				m.Base = openTestDump(t, tt.base)
+			}
+			var inputs []*sql.DB
+			for _, data := range tt.inputs {
+				inputs = append(inputs, openTestDump(t, data))
+			}
+			out := CreateDump(filepath.Join(t.TempDir(), "output.sql"))
+			err := m.Merge(context.Background(), inputs, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := loadTest(t, out)[0]
+			if len(s.orgs) != len(tt.orgs) || len(s.domains) != len(tt.domains) {
+				t.Fatalf("got organizations %v, domains %v", s.orgs, s.domains)
+			}
+			for id, name := range s.orgs {
+				if tt.orgs[strings.ToLower(name)] != id {
+					t.Fatalf("organization %s got ID %d", name, id)
+				}
+			}
+			for lDomain, do := range s.domains {
+				if tt.domains[lDomain] != do.ID {
+					t.Fatalf("domain %s got ID %d, want %d", do.Domain, do.ID, tt.domains[lDomain])
+				}
+			}
+		})
+	}
+}
+
+func TestIDMapping(t *testing.T) {
+	m := testMerger()
+	m.Base = openTestDump(t, testBase)
+	var csv bytes.Buffer
+	m.IDMap = &csv
+	err := m.Merge(context.Background(), []*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}, CreateDump(filepath.Join(t.TempDir(), "output.sql")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every input row is in the output, even when a three-way merge took it from the other input
+	want := `db,table,old_id,new_id
+1,organizations,1,1
+1,organizations,2,2
+1,domains_organizations,1,1
+1,domains_organizations,2,2
+1,enrollments,1,1
+1,enrollments,2,2
+2,organizations,5,2
+2,organizations,6,1
+2,domains_organizations,7,1
+2,domains_organizations,8,2
+2,enrollments,10,1
+2,enrollments,11,2
+`
+	if csv.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", csv.String(), want)
+	}
+}
@@ -0,0 +1,449 @@
+package shmerge
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watermarkTable holds, for every input database, the highest last_modified merged so far
+// Rows are keyed by SHA-256 of Merger.InputIDs, not by input positions, so reordered inputs keep their watermarks
+const watermarkTable = "merge_watermark"
+
+// minWatermark is stored for inputs without any uidentities and identities
+var minWatermark = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// createWatermarkTable creates watermarks table in the output database, unless it exists
+// It must be called outside of the write transaction, MySQL commits transactions on create table
+func createWatermarkTable(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "create table if not exists "+watermarkTable+"(input char(64) not null, last_modified datetime(6) not null, primary key(input))")
+	return wrapError(err, watermarkTable, OutputDB, "create table", "")
+}
+
+// inputKeys returns keys of watermarks of n inputs, SHA-256 of m.InputIDs in inputs order
+func (m *Merger) inputKeys(n int) ([]string, error) {
+	if len(m.InputIDs) != n {
+		return nil, fmt.Errorf("incremental merge needs InputIDs of all inputs, got %d for %d inputs", len(m.InputIDs), n)
+	}
+	keys := make([]string, n)
+	seen := make(map[string]int)
+	for i, id := range m.InputIDs {
+		sum := sha256.Sum256([]byte(id))
+		keys[i] = hex.EncodeToString(sum[:])
+		if j, ok := seen[keys[i]]; ok {
+			return nil, fmt.Errorf("%s and %s have the same InputIDs", dbName(j+1), dbName(i+1))
+		}
+		seen[keys[i]] = i
+	}
+	return keys, nil
+}
+
+// readWatermarks returns watermarks stored in the output database by input keys
+func readWatermarks(ctx context.Context, db *sql.DB) (map[string]time.Time, error) {
+	watermarks := make(map[string]time.Time)
+	key := ""
+	var modified time.Time
+	err := queryRows(ctx, db, watermarkTable, OutputDB, "select input, last_modified from "+watermarkTable, func(rows *sql.Rows) error {
+		err := rows.Scan(&key, &modified)
+		if err != nil {
+			return err
+		}
+		toUTC(&modified)
+		watermarks[key] = modified
+		return nil
+	})
+	return watermarks, err
+}
+
+// writeWatermarks replaces watermarks stored in the output database using tx, keys and watermarks are in inputs order
+// Watermarks of inputs no longer merged (or having other InputIDs) are deleted
+func (m *Merger) writeWatermarks(ctx context.Context, tx *sql.Tx, keys []string, watermarks []time.Time) error {
+	_, err := tx.ExecContext(ctx, "delete from "+watermarkTable)
+	if err != nil {
+		return wrapError(err, watermarkTable, OutputDB, "delete", "")
+	}
+	ins := m.newInserter(ctx, tx, watermarkTable, "input", "last_modified")
+	for i, modified := range watermarks {
+		err := ins.add(dbName(i+1), keys[i], modified)
+		if err != nil {
+			return err
+		}
+	}
+	return ins.flush()
+}
+
+// newWatermarks returns the highest last_modified of uidentities and identities read from every input
+// Previous watermarks (in inputs order) are kept when nothing newer was read, prev can be nil
+func newWatermarks(srcs []*snapshot, prev []time.Time) []time.Time {
+	var watermarks []time.Time
+	for i, s := range srcs {
+		watermark := minWatermark
+		if prev != nil {
+			watermark = prev[i]
+		}
+		for _, modified := range s.uidentities {
+			if modified.After(watermark) {
+				watermark = modified
+			}
+		}
+		for _, iy := range s.identities {
+			if iy.LastModified != nil && iy.LastModified.After(watermark) {
+				watermark = *iy.LastModified
+			}
+		}
+		watermarks = append(watermarks, watermark)
+	}
+	return watermarks
+}
+
+// changedUUIDs returns sorted uuids of uidentities changed (or having identities changed) in any input since its watermark
+// Rows modified exactly at the watermark are returned again, merging them twice gives the same result
+// watermarks are in inputs order
+func (m *Merger) changedUUIDs(ctx context.Context, inputs []*sql.DB, watermarks []time.Time) ([]string, error) {
+	concurrency := m.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	g := newGroup(ctx, concurrency)
+	changed := make([]map[string]struct{}, 2*len(inputs))
+	for i, db := range inputs {
+		db, dbNum, watermark := db, i+1, watermarks[i]
+		for j, table := range []string{"uidentities", "identities"} {
+			table, uuids := table, make(map[string]struct{})
+			changed[2*i+j] = uuids
+			g.do(func(ctx context.Context) error {
+				uuid := ""
+				return queryRows(ctx, db, table, dbNum, "select uuid from "+table+" where uuid is not null and last_modified >= ?", func(rows *sql.Rows) error {
+					err := rows.Scan(&uuid)
+					if err != nil {
+						return err
+					}
+					uuids[uuid] = struct{}{}
+					return nil
+				}, watermark)
+			})
+		}
+	}
+	err := g.wait()
+	if err != nil {
+		return nil, err
+	}
+	all := make(map[string]struct{})
+	for _, uuids := range changed {
+		for uuid := range uuids {
+			all[uuid] = struct{}{}
+		}
+	}
+	uuids := make([]string, 0, len(all))
+	for uuid := range all {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids, nil
+}
+
+// mergeIncremental merges uidentities changed since watermarks stored in the output database and upserts them into it
+// Countries and organizations are read in full, other non-uidentity tables are not merged
+// It returns false without doing anything when watermarks of some inputs are missing (or their InputIDs changed),
+// a full merge is needed then
+func (m *Merger) mergeIncremental(ctx context.Context, inputs []*sql.DB, output *sql.DB) (bool, error) {
+	switch {
+	case m.Base != nil:
+		return false, fmt.Errorf("incremental merge cannot be three-way")
+	case m.ExportConflicts != nil || m.ApplyConflicts != nil:
+		return false, fmt.Errorf("incremental merge cannot export or apply conflicts files")
+	case m.PreserveIDs || m.IDMap != nil || m.IDMapTable != "":
+		return false, fmt.Errorf("incremental merge cannot preserve or map IDs")
+	}
+	keys, err := m.inputKeys(len(inputs))
+	if err != nil {
+		return false, err
+	}
+	if !m.DryRun {
+		err = createWatermarkTable(ctx, output)
+		if err != nil {
+			return false, err
+		}
+	}
+	stored, err := readWatermarks(ctx, output)
+	if err != nil {
+		if m.DryRun {
+			return false, nil
+		}
+		return false, err
+	}
+	watermarks := make([]time.Time, len(inputs))
+	for i, key := range keys {
+		watermark, ok := stored[key]
+		if !ok {
+			return false, nil
+		}
+		watermarks[i] = watermark
+	}
+	order, err := m.priorityOrder(len(inputs))
+	if err != nil {
+		return false, err
+	}
+	uuids, err := m.changedUUIDs(ctx, inputs, watermarks)
+	if err != nil {
+		return false, err
+	}
+	m.printf("%d uidentities changed since the previous merge\n", len(uuids))
+	if len(uuids) == 0 {
+		return true, nil
+	}
+	var dbNums []int
+	for i := range inputs {
+		dbNums = append(dbNums, i+1)
+	}
+	load := func(g *group, db *sql.DB, dbNum int, s *snapshot) {
+		loadReferenceTables(g, db, dbNum, s)
+		loadUUIDTables(g, db, dbNum, s, uuids)
+	}
+	srcs, err := m.loadDatabases(ctx, inputs, dbNums, load)
+	if err != nil {
+		return false, err
+	}
+	sources := srcs
+	if m.Upsert {
+		// rows of changed uidentities in the output database are merged as an additional source
+		outs, err := m.loadDatabases(ctx, []*sql.DB{output}, []int{OutputDB}, load)
+		if err != nil {
+			return false, err
+		}
+		sources = append(append([]*snapshot{}, srcs...), outs[0])
+		dbNums = append(dbNums, OutputDB)
+		order, err = m.upsertOrder(order, len(inputs))
+		if err != nil {
+			return false, err
+		}
+	}
+	plan := newPlan(dbNums)
+	merged, err := m.mergeSnapshots(sources, order, plan, m.Resolver)
+	if err != nil {
+		return false, err
+	}
+	if m.Upsert {
+		pruneOutputOnly(merged, srcs)
+	}
+	plan.countRows(merged)
+	plan.sortConflicts()
+	err = m.writeReports(plan)
+	if err != nil {
+		return false, err
+	}
+	if m.DryRun {
+		if m.Out == nil {
+			return true, nil
+		}
+		return true, plan.Print(m.Out)
+	}
+	return true, m.writeDatabase(ctx, output, func(ctx context.Context, tx *sql.Tx) error {
+		err := m.writeChanged(ctx, tx, merged, uuids)
+		if err != nil {
+			return err
+		}
+		return m.writeWatermarks(ctx, tx, keys, newWatermarks(srcs, watermarks))
+	})
+}
+
+// execUUIDs runs query ending with "in" for uuids (in chunks) using tx
+func execUUIDs(ctx context.Context, tx *sql.Tx, table, query string, uuids []string) error {
+	for from := 0; from < len(uuids); from += uuidsChunk {
+		to := from + uuidsChunk
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		args := make([]interface{}, 0, to-from)
+		for _, uuid := range uuids[from:to] {
+			args = append(args, uuid)
+		}
+		_, err := tx.ExecContext(ctx, query+" (?"+strings.Repeat(", ?", len(args)-1)+")", args...)
+		if err != nil {
+			return wrapError(err, table, OutputDB, "delete", uuids[from])
+		}
+	}
+	return nil
+}
+
+// writeChanged replaces all rows of changed uuids in the output database using tx
+// Missing countries and organizations are added, new organizations and enrollments get IDs greater than existing ones,
+// enrollments already present in the output database keep their IDs
+func (m *Merger) writeChanged(ctx context.Context, tx *sql.Tx, s *snapshot, uuids []string) error {
+	codes := make(map[string]struct{})
+	code := ""
+	err := queryTxRows(ctx, tx, "countries", "select code from countries", func(rows *sql.Rows) error {
+		err := rows.Scan(&code)
+		if err != nil {
+			return err
+		}
+		codes[code] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for code := range s.countries {
+		if _, ok := codes[code]; !ok {
+			keys = append(keys, code)
+		}
+	}
+	sort.Strings(keys)
+	ins := m.newInserter(ctx, tx, "countries", "code", "name", "alpha3")
+	for _, code := range keys {
+		c := s.countries[code]
+		err := ins.add(c.Code, c.Code, c.Name, c.Alpha3)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	// organizations differing only in case: the one with the lowest ID is used, just like when loading
+	orgIDs := make(map[string]int64)
+	maxOrgID := int64(0)
+	id := int64(0)
+	name := ""
+	err = queryTxRows(ctx, tx, "organizations", "select id, name from organizations", func(rows *sql.Rows) error {
+		err := rows.Scan(&id, &name)
+		if err != nil {
+			return err
+		}
+		lName := strings.ToLower(name)
+		prevID, ok := orgIDs[lName]
+		if !ok || id < prevID {
+			orgIDs[lName] = id
+		}
+		if id > maxOrgID {
+			maxOrgID = id
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "organizations", "id", "name")
+	enrollmentKeys := sortedEnrollmentKeys(s.enrollments)
+	for _, k := range enrollmentKeys {
+		lName := strings.ToLower(s.enrollments[k].OrgName)
+		if _, ok := orgIDs[lName]; ok {
+			continue
+		}
+		maxOrgID++
+		orgIDs[lName] = maxOrgID
+		err := ins.add(s.orgNames[lName], maxOrgID, s.orgNames[lName])
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	mapOrg := func(table, orgName, key string) (int64, error) {
+		id, ok := orgIDs[strings.ToLower(orgName)]
+		if !ok {
+			return 0, wrapError(fmt.Errorf("%w Name %s", ErrUnknownOrganization, orgName), table, OutputDB, "map organization", key)
+		}
+		return id, nil
+	}
+	var maxEnrollmentID sql.NullInt64
+	err = tx.QueryRowContext(ctx, "select max(id) from enrollments").Scan(&maxEnrollmentID)
+	if err != nil {
+		return wrapError(err, "enrollments", OutputDB, "query", "")
+	}
+	// enrollments still present keep their IDs, they are deleted and inserted again
+	keptIDs := make(map[EnrollmentKey]int64)
+	var e Enrollment
+	err = queryTxUUIDRows(ctx, tx, "enrollments", "select id, start, end, uuid from enrollments where uuid in", uuids, func(rows *sql.Rows) error {
+		err := rows.Scan(&e.ID, &e.Start, &e.End, &e.UUID)
+		if err != nil {
+			return err
+		}
+		toUTC(&e.Start, &e.End)
+		keptIDs[EnrollmentKey{Start: e.Start, End: e.End, UUID: e.UUID}] = e.ID
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	enrollmentIDs := make(map[EnrollmentKey]int64)
+	for _, k := range enrollmentKeys {
+		id, ok := keptIDs[k]
+		if !ok {
+			maxEnrollmentID.Int64++
+			id = maxEnrollmentID.Int64
+		}
+		enrollmentIDs[k] = id
+	}
+	// identities could have been moved from other uidentities, so they are deleted by their IDs too
+	var identityIDs []string
+	for id := range s.identities {
+		identityIDs = append(identityIDs, id)
+	}
+	sort.Strings(identityIDs)
+	for _, del := range []struct {
+		table, query string
+		keys         []string
+	}{
+		{"enrollments", "delete from enrollments where uuid in", uuids},
+		{"identities", "delete from identities where uuid in", uuids},
+		{"identities", "delete from identities where id in", identityIDs},
+		{"profiles", "delete from profiles where uuid in", uuids},
+		{"uidentities", "delete from uidentities where uuid in", uuids},
+	} {
+		err := execUUIDs(ctx, tx, del.table, del.query, del.keys)
+		if err != nil {
+			return err
+		}
+	}
+	return m.writeUUIDTables(ctx, tx, s, enrollmentIDs, mapOrg)
+}
+
+// queryTxUUIDRows runs query ending with "in" for uuids (in chunks) using tx, like queryTxRows
+func queryTxUUIDRows(ctx context.Context, tx *sql.Tx, table, query string, uuids []string, scan func(*sql.Rows) error) error {
+	for from := 0; from < len(uuids); from += uuidsChunk {
+		to := from + uuidsChunk
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		args := make([]interface{}, 0, to-from)
+		for _, uuid := range uuids[from:to] {
+			args = append(args, uuid)
+		}
+		err := queryTxRows(ctx, tx, table, query+" (?"+strings.Repeat(", ?", len(args)-1)+")", scan, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryTxRows runs query with args using tx and calls scan for every returned row
+func queryTxRows(ctx context.Context, tx *sql.Tx, table, query string, scan func(*sql.Rows) error, args ...interface{}) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return wrapError(err, table, OutputDB, "query", "")
+	}
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			_ = rows.Close()
+			return wrapError(err, table, OutputDB, "scan", "")
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return wrapError(err, table, OutputDB, "query", "")
+	}
+	return wrapError(rows.Close(), table, OutputDB, "query", "")
+}
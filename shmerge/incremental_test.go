@@ -0,0 +1,149 @@
+//go:build cgo
+// +build cgo
+
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIncrementalKeepsEnrollmentIDs(t *testing.T) {
+	ctx := context.Background()
+	in := openTestSQLite(t, testBase)
+	out := openTestSQLite(t, "")
+	m := testMerger()
+	m.Incremental = true
+	m.InputIDs = []string{"in"}
+	enrollmentIDs := func() map[EnrollmentKey]int64 {
+		ids := make(map[EnrollmentKey]int64)
+		for k, e := range loadTest(t, out)[0].enrollments {
+			ids[k] = e.ID
+		}
+		return ids
+	}
+	err := m.Merge(ctx, []*sql.DB{in}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := enrollmentIDs()
+	_, err = in.Exec("insert into enrollments(id, start, end, uuid, organization_id) values(3, '2000-01-01 00:00:00', '2010-01-01 00:00:00', 'u2', 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second incremental merge of the same uidentity doesn't change IDs either
+	want := len(before) + 1
+	for _, last := range []string{"2021-01-01 00:00:00", "2022-01-01 00:00:00"} {
+		_, err = in.Exec("update uidentities set last_modified = ? where uuid = 'u2'", last)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Merge(ctx, []*sql.DB{in}, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after := enrollmentIDs()
+		if len(after) != want {
+			t.Fatalf("got %d enrollments, want %d", len(after), want)
+		}
+		for k, id := range before {
+			if after[k] != id {
+				t.Fatalf("enrollment %s ID changed from %d to %d", k, id, after[k])
+			}
+		}
+		before = after
+	}
+}
+
+func TestIncrementalInputIDs(t *testing.T) {
+	ctx := context.Background()
+	first, second := openTestSQLite(t, testBase), openTestSQLite(t, testChanged)
+	// the first input has a watermark newer than the second one
+	_, err := first.Exec("update uidentities set last_modified = '2022-01-01 00:00:00'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := openTestSQLite(t, "")
+	var log bytes.Buffer
+	merge := func(inputs []*sql.DB, ids ...string) {
+		t.Helper()
+		log.Reset()
+		m := testMerger()
+		m.Out = &log
+		m.Incremental = true
+		m.InputIDs = ids
+		err := m.Merge(ctx, inputs, out)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	storedKeys := func() []string {
+		t.Helper()
+		var keys []string
+		err := queryRows(ctx, out, watermarkTable, OutputDB, "select input from "+watermarkTable+" order by input", func(rows *sql.Rows) error {
+			key := ""
+			err := rows.Scan(&key)
+			keys = append(keys, key)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	merge([]*sql.DB{first, second}, "first", "second")
+	if keys := storedKeys(); len(keys) != 2 {
+		t.Fatalf("got watermarks %v, want 2", keys)
+	}
+
+	// u3 is older than the watermark of the first input, so it is only merged when the second input keeps its watermark
+	_, err = second.Exec("insert into uidentities(uuid, last_modified) values('u3', '2021-01-01 00:00:00')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	merge([]*sql.DB{second, first}, "second", "first")
+	// rows modified at the watermark are merged again: u1 and u2 of the second input
+	if !strings.Contains(log.String(), "3 uidentities changed since the previous merge") {
+		t.Fatalf("reordered inputs not merged incrementally:\n%s", log.String())
+	}
+	if _, ok := loadTest(t, out)[0].uidentities["u3"]; !ok {
+		t.Fatal("uidentity added to the reordered input not merged")
+	}
+
+	// an input with another ID has no watermark, the full merge replaces watermarks of all inputs
+	before := storedKeys()
+	merge([]*sql.DB{second, first}, "second", "renamed")
+	if !strings.Contains(log.String(), "no watermarks stored for all inputs") {
+		t.Fatalf("input with a changed ID merged incrementally:\n%s", log.String())
+	}
+	after := storedKeys()
+	if len(after) != 2 || reflect.DeepEqual(after, before) {
+		t.Fatalf("got watermarks %v, before %v", after, before)
+	}
+}
+
+func TestIncrementalInputIDsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		err  string
+	}{
+		{"missing", nil, "incremental merge needs InputIDs of all inputs, got 0 for 2 inputs"},
+		{"duplicate", []string{"a", "a"}, "1st input database and 2nd input database have the same InputIDs"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := testMerger()
+			m.Incremental = true
+			m.InputIDs = test.ids
+			err := m.Merge(context.Background(), []*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}, openTestSQLite(t, ""))
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package shmerge
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uuidsChunk is the maximum number of uuids used by a single query
+const uuidsChunk = 1000
+
+// snapshot holds all Sorting Hat tables read from a single database
+type snapshot struct {
+	countries   map[string]Country
+	orgs        map[int64]string             // organization ID -> name
+	orgNames    map[string]string            // lower case organization name -> name
+	domains     map[string]DomainOrg         // lower case domain -> domain-organization
+	blacklist   map[string]string            // lower case excluded -> excluded
+	uidentities map[string]time.Time         // uuid -> last_modified
+	profiles    map[string]Profile           // uuid -> profile
+	identities  map[string]Identity          // id -> identity
+	enrollments map[EnrollmentKey]Enrollment // (uuid, start, end) -> enrollment
+	// archive tables
+	uidentitiesArchive map[ArchiveKey]*time.Time // (uuid, archived_at) -> last_modified
+	profilesArchive    map[ArchiveKey]Profile    // (uuid, archived_at) -> profile
+	identitiesArchive  map[ArchiveKey]Identity   // (id, archived_at) -> identity
+	enrollmentsArchive map[ArchiveKey]Enrollment // ("uuid start end", archived_at) -> enrollment
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{
+		countries:   make(map[string]Country),
+		orgs:        make(map[int64]string),
+		orgNames:    make(map[string]string),
+		domains:     make(map[string]DomainOrg),
+		blacklist:   make(map[string]string),
+		uidentities: make(map[string]time.Time),
+		profiles:    make(map[string]Profile),
+		identities:  make(map[string]Identity),
+		enrollments: make(map[EnrollmentKey]Enrollment),
+
+		uidentitiesArchive: make(map[ArchiveKey]*time.Time),
+		profilesArchive:    make(map[ArchiveKey]Profile),
+		identitiesArchive:  make(map[ArchiveKey]Identity),
+		enrollmentsArchive: make(map[ArchiveKey]Enrollment),
+	}
+}
+
+// clone returns a copy of s, its tables can be modified without changing s
+func (s *snapshot) clone() *snapshot {
+	c := newSnapshot()
+	for k, v := range s.countries {
+		c.countries[k] = v
+	}
+	for k, v := range s.orgs {
+		c.orgs[k] = v
+	}
+	for k, v := range s.orgNames {
+		c.orgNames[k] = v
+	}
+	for k, v := range s.domains {
+		c.domains[k] = v
+	}
+	for k, v := range s.blacklist {
+		c.blacklist[k] = v
+	}
+	for k, v := range s.uidentities {
+		c.uidentities[k] = v
+	}
+	for k, v := range s.profiles {
+		c.profiles[k] = v
+	}
+	for k, v := range s.identities {
+		c.identities[k] = v
+	}
+	for k, v := range s.enrollments {
+		c.enrollments[k] = v
+	}
+	for k, v := range s.uidentitiesArchive {
+		c.uidentitiesArchive[k] = v
+	}
+	for k, v := range s.profilesArchive {
+		c.profilesArchive[k] = v
+	}
+	for k, v := range s.identitiesArchive {
+		c.identitiesArchive[k] = v
+	}
+	for k, v := range s.enrollmentsArchive {
+		c.enrollmentsArchive[k] = v
+	}
+	return c
+}
+
+// queryRows runs query with args on db and calls scan for every returned row
+func queryRows(ctx context.Context, db *sql.DB, table string, dbNum int, query string, scan func(*sql.Rows) error, args ...interface{}) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return wrapError(err, table, dbNum, "query", "")
+	}
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			_ = rows.Close()
+			var mErr *Error
+			if errors.As(err, &mErr) {
+				return err
+			}
+			return wrapError(err, table, dbNum, "scan", "")
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		_ = rows.Close()
+		return wrapError(err, table, dbNum, "query", "")
+	}
+	return wrapError(rows.Close(), table, dbNum, "query", "")
+}
+
+// loadDatabases reads tables from dbs concurrently using load (loadTables reads all merged tables), dbNums are their numbers (1-based input numbers or BaseDB)
+// At most m.Concurrency tables are read at once, the first error cancels all other reads
+func (m *Merger) loadDatabases(ctx context.Context, dbs []*sql.DB, dbNums []int, load func(g *group, db *sql.DB, dbNum int, s *snapshot)) ([]*snapshot, error) {
+	concurrency := m.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	g := newGroup(ctx, concurrency)
+	snaps := make([]*snapshot, len(dbs))
+	for i, db := range dbs {
+		m.printf("reading %s...\n", dbName(dbNums[i]))
+		snaps[i] = newSnapshot()
+		load(g, db, dbNums[i], snaps[i])
+	}
+	err := g.wait()
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range snaps {
+		err = s.mapOrgNames(dbNums[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snaps, nil
+}
+
+// loadTables schedules reading every merged table from dbNum-th database into s using g
+// Tables are independent, each one is written into its own map of s
+func loadTables(g *group, db *sql.DB, dbNum int, s *snapshot) {
+	loadReferenceTables(g, db, dbNum, s)
+	loadLookupTables(g, db, dbNum, s)
+	loadUUIDTables(g, db, dbNum, s, nil)
+	loadArchives(g, db, dbNum, s)
+}
+
+// loadLookupTables schedules reading domains_organizations and matching_blacklist from dbNum-th database into s using g
+func loadLookupTables(g *group, db *sql.DB, dbNum int, s *snapshot) {
+	g.do(func(ctx context.Context) error {
+		var do DomainOrg
+		return queryRows(ctx, db, "domains_organizations", dbNum, "select id, domain, is_top_domain, organization_id from domains_organizations", func(rows *sql.Rows) error {
+			err := rows.Scan(&do.ID, &do.Domain, &do.IsTopDomain, &do.OrgID)
+			if err != nil {
+				return err
+			}
+			// domains differing only in case: the one with the lowest ID is used
+			lDomain := strings.ToLower(do.Domain)
+			prev, ok := s.domains[lDomain]
+			if !ok || do.ID < prev.ID {
+				s.domains[lDomain] = do
+			}
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		bl := ""
+		return queryRows(ctx, db, "matching_blacklist", dbNum, "select excluded from matching_blacklist", func(rows *sql.Rows) error {
+			err := rows.Scan(&bl)
+			if err != nil {
+				return err
+			}
+			// entries differing only in case: the first one in byte order is used
+			lBl := strings.ToLower(bl)
+			prev, ok := s.blacklist[lBl]
+			if !ok || bl < prev {
+				s.blacklist[lBl] = bl
+			}
+			return nil
+		})
+	})
+}
+
+// loadReferenceTables schedules reading countries and organizations from dbNum-th database into s using g
+func loadReferenceTables(g *group, db *sql.DB, dbNum int, s *snapshot) {
+	g.do(func(ctx context.Context) error {
+		var c Country
+		return queryRows(ctx, db, "countries", dbNum, "select code, name, alpha3 from countries", func(rows *sql.Rows) error {
+			err := rows.Scan(&c.Code, &c.Name, &c.Alpha3)
+			if err != nil {
+				return err
+			}
+			s.countries[c.Code] = c
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		id := int64(0)
+		name := ""
+		// names differing only in case: the one with the lowest ID is used
+		lowestID := make(map[string]int64)
+		return queryRows(ctx, db, "organizations", dbNum, "select id, name from organizations", func(rows *sql.Rows) error {
+			err := rows.Scan(&id, &name)
+			if err != nil {
+				return err
+			}
+			s.orgs[id] = name
+			lName := strings.ToLower(name)
+			prevID, ok := lowestID[lName]
+			if !ok || id < prevID {
+				s.orgNames[lName] = name
+				lowestID[lName] = id
+			}
+			return nil
+		})
+	})
+}
+
+// loadUUIDTables schedules reading uidentities, profiles, identities and enrollments from dbNum-th database into s using g
+// When uuids is not nil, only rows of these uidentities are read
+func loadUUIDTables(g *group, db *sql.DB, dbNum int, s *snapshot, uuids []string) {
+	g.do(func(ctx context.Context) error {
+		uuid := ""
+		var modified time.Time
+		return queryUUIDRows(ctx, db, "uidentities", dbNum, "select uuid, last_modified from uidentities", uuids, func(rows *sql.Rows) error {
+			err := rows.Scan(&uuid, &modified)
+			if err != nil {
+				return err
+			}
+			toUTC(&modified)
+			s.uidentities[uuid] = modified
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var p Profile
+		return queryUUIDRows(ctx, db, "profiles", dbNum, "select uuid, name, email, gender, gender_acc, is_bot, country_code from profiles", uuids, func(rows *sql.Rows) error {
+			err := rows.Scan(&p.UUID, &p.Name, &p.Email, &p.Gender, &p.GenderAcc, &p.IsBot, &p.CountryCode)
+			if err != nil {
+				return err
+			}
+			s.profiles[p.UUID] = p
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var iy Identity
+		return queryUUIDRows(ctx, db, "identities", dbNum, "select id, name, email, username, source, uuid, last_modified from identities", uuids, func(rows *sql.Rows) error {
+			err := rows.Scan(&iy.ID, &iy.Name, &iy.Email, &iy.Username, &iy.Source, &iy.UUID, &iy.LastModified)
+			if err != nil {
+				return err
+			}
+			toUTC(iy.LastModified)
+			s.identities[iy.ID] = iy
+			return nil
+		})
+	})
+	g.do(func(ctx context.Context) error {
+		var e Enrollment
+		return queryUUIDRows(ctx, db, "enrollments", dbNum, "select id, start, end, uuid, organization_id from enrollments", uuids, func(rows *sql.Rows) error {
+			err := rows.Scan(&e.ID, &e.Start, &e.End, &e.UUID, &e.OrgID)
+			if err != nil {
+				return err
+			}
+			toUTC(&e.Start, &e.End)
+			s.enrollments[EnrollmentKey{Start: e.Start, End: e.End, UUID: e.UUID}] = e
+			return nil
+		})
+	})
+}
+
+// toUTC converts times read from a database into UTC, nil pointers are skipped
+// Drivers return times in different locations (lib/pq uses an unnamed fixed zone), and times used in map keys
+// (EnrollmentKey, ArchiveKey) only compare equal when their locations do
+func toUTC(times ...*time.Time) {
+	for _, t := range times {
+		if t != nil {
+			*t = t.UTC()
+		}
+	}
+}
+
+// queryUUIDRows runs query on db like queryRows, when uuids is not nil only rows of these uidentities are returned
+// Rows are queried in chunks of uuidsChunk uuids
+func queryUUIDRows(ctx context.Context, db *sql.DB, table string, dbNum int, query string, uuids []string, scan func(*sql.Rows) error) error {
+	if uuids == nil {
+		return queryRows(ctx, db, table, dbNum, query, scan)
+	}
+	for from := 0; from < len(uuids); from += uuidsChunk {
+		to := from + uuidsChunk
+		if to > len(uuids) {
+			to = len(uuids)
+		}
+		args := make([]interface{}, 0, to-from)
+		for _, uuid := range uuids[from:to] {
+			args = append(args, uuid)
+		}
+		err := queryRows(ctx, db, table, dbNum, query+" where uuid in (?"+strings.Repeat(", ?", len(args)-1)+")", scan, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapOrgNames maps organization IDs of domains, enrollments and archived enrollments read from dbNum-th database into names
+// It must succeed for domains and enrollments
+func (s *snapshot) mapOrgNames(dbNum int) error {
+	for lDomain, do := range s.domains {
+		orgName, ok := s.orgs[do.OrgID]
+		if !ok {
+			return wrapError(fmt.Errorf("%w %d", ErrUnknownOrganization, do.OrgID), "domains_organizations", dbNum, "map organization", do.Domain)
+		}
+		do.OrgName = orgName
+		s.domains[lDomain] = do
+	}
+	for k, e := range s.enrollments {
+		orgName, ok := s.orgs[e.OrgID]
+		if !ok {
+			return wrapError(fmt.Errorf("%w %d", ErrUnknownOrganization, e.OrgID), "enrollments", dbNum, "map organization", e.UUID)
+		}
+		e.OrgName = orgName
+		s.enrollments[k] = e
+	}
+	// archive tables have no foreign keys, archived enrollments of deleted organizations keep an empty name
+	for k, e := range s.enrollmentsArchive {
+		e.OrgName = s.orgs[e.OrgID]
+		s.enrollmentsArchive[k] = e
+	}
+	return nil
+}
+
+// checksum returns SHA-256 of all rows, it doesn't depend on map iteration order
+func (s *snapshot) checksum() string {
+	var rows []string
+	for _, c := range s.countries {
+		rows = append(rows, "countries "+c.String())
+	}
+	for id, name := range s.orgs {
+		rows = append(rows, fmt.Sprintf("organizations {id:%d, name:%s}", id, name))
+	}
+	for _, do := range s.domains {
+		rows = append(rows, "domains_organizations "+do.String())
+	}
+	for _, bl := range s.blacklist {
+		rows = append(rows, "matching_blacklist "+bl)
+	}
+	for uuid, modified := range s.uidentities {
+		rows = append(rows, "uidentities "+uuid+" "+modified.UTC().Format(time.RFC3339Nano))
+	}
+	for _, p := range s.profiles {
+		rows = append(rows, "profiles "+p.String())
+	}
+	for _, i := range s.identities {
+		rows = append(rows, "identities "+i.String())
+	}
+	for _, e := range s.enrollments {
+		rows = append(rows, "enrollments "+e.String())
+	}
+	for k, modified := range s.uidentitiesArchive {
+		row := "uidentities_archive " + k.String() + " "
+		if modified != nil {
+			row += modified.UTC().Format(time.RFC3339Nano)
+		}
+		rows = append(rows, row)
+	}
+	for k, p := range s.profilesArchive {
+		rows = append(rows, "profiles_archive "+k.String()+" "+p.String())
+	}
+	for k, i := range s.identitiesArchive {
+		rows = append(rows, "identities_archive "+k.String()+" "+i.String())
+	}
+	for k, e := range s.enrollmentsArchive {
+		rows = append(rows, "enrollments_archive "+k.String()+" "+e.String())
+	}
+	sort.Strings(rows)
+	h := sha256.New()
+	for _, row := range rows {
+		h.Write([]byte(row + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,25 @@
+package shmerge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToUTC(t *testing.T) {
+	// lib/pq returns times of timestamp columns in an unnamed zero offset zone
+	pq := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.FixedZone("", 0))
+	utc := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	keys := map[EnrollmentKey]bool{{Start: utc, End: utc, UUID: "u1"}: true}
+	if keys[EnrollmentKey{Start: pq, End: pq, UUID: "u1"}] {
+		t.Fatal("times in other locations are expected to give other keys")
+	}
+	start, end := pq, time.Date(2020, 1, 2, 5, 4, 5, 6000, time.FixedZone("CEST", 2*60*60))
+	var modified *time.Time
+	toUTC(&start, &end, modified)
+	if !keys[EnrollmentKey{Start: start, End: end, UUID: "u1"}] {
+		t.Fatalf("key of times %v, %v not found after converting them into UTC", start, end)
+	}
+	if start.Location() != time.UTC || end.Location() != time.UTC {
+		t.Fatalf("got locations %v, %v", start.Location(), end.Location())
+	}
+}
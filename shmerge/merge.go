@@ -0,0 +1,778 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConcurrency is the maximum number of tables read at once when Merger.Concurrency is not set
+const DefaultConcurrency = 4
+
+// Merger merges Sorting Hat databases
+type Merger struct {
+	// Debug enables verbose output about rows added from a single input
+	Debug bool
+	// Out receives progress and conflict messages, defaults to os.Stdout
+	Out io.Writer
+	// Priority lists 1-based input database numbers from the highest to the lowest priority
+	// It is used when a conflict cannot be resolved otherwise, nil means inputs order
+	Priority []int
+	// Base is an optional common ancestor of all inputs, when set a three-way merge is done
+	Base *sql.DB
+	// DryRun only prints the merge plan, without writing to the output database
+	DryRun bool
+	// ConflictsJSON and ConflictsCSV receive conflicts report (JSON lines and CSV), if set
+	ConflictsJSON io.Writer
+	ConflictsCSV  io.Writer
+	// Policies configures how conflicting fields are resolved, nil means DefaultPolicies
+	Policies Policies
+	// Resolver can override rows merged using policies, for example by asking the operator
+	Resolver Resolver
+	// ExportConflicts receives all conflicts with proposed resolutions as an editable conflicts file
+	// (see ConflictsFile), output database is not written then
+	ExportConflicts io.Writer
+	// ApplyConflicts is a conflicts file edited by the operator, its choices resolve all conflicts
+	// Merge fails if any input changed since it was exported or if a conflict is missing in it
+	ApplyConflicts *ConflictsFile
+	// BatchSize is the number of rows inserted by a single statement, DefaultBatchSize when not set
+	BatchSize int
+	// Concurrency is the maximum number of tables read at once from all databases, DefaultConcurrency when not set
+	Concurrency int
+	// PreserveIDs keeps organization and domain IDs from the first input, other rows get IDs not used there
+	// When not set all IDs are allocated from 1 in names order
+	PreserveIDs bool
+	// IDMap receives mapping of organization, domain and enrollment IDs from every input into the output database as CSV (see WriteIDMapCSV)
+	// It is written after the output database is written
+	IDMap io.Writer
+	// IDMapTable is the name of a table in the output database receiving the same mapping (created if missing)
+	// Columns are: db, table_name, old_id, new_id
+	IDMapTable string
+	// Upsert merges the output database as an additional source and changes only rows that differ in it
+	// Rows not present in any input are deleted, rows present in inputs keep their output IDs
+	Upsert bool
+	// OutputPriority is the 1-based position of the output database in the priority order when upserting, 0 means the lowest priority
+	OutputPriority int
+	// Incremental only merges uidentities changed (or having identities changed) since the previous incremental merge
+	// Watermarks of all inputs are stored in the output database, when they are missing a full merge is done (an upsert if Upsert is set)
+	// Deletions are not handled: uidentities deleted from all inputs (with their rows) stay in the output database until a full merge,
+	// just like changes of domains, blacklist and archive tables
+	Incremental bool
+	// InputIDs are stable identities of inputs in inputs order, like their DSNs, required by incremental merges
+	// Watermarks are stored by SHA-256 of them, so reordered inputs keep their watermarks and an input with a changed ID gets a full merge
+	InputIDs []string
+}
+
+// NewMerger returns a Merger with default settings
+func NewMerger() *Merger {
+	return &Merger{Out: os.Stdout}
+}
+
+// Merge merges input databases into the output database
+// In dry-run mode it only prints the merge plan, when exporting conflicts it only writes them, output database is not touched
+func (m *Merger) Merge(ctx context.Context, inputs []*sql.DB, output *sql.DB) error {
+	return m.mergeInto(ctx, inputs, output, m.Incremental)
+}
+
+// mergeInto merges input databases into the output database, when incremental is set an incremental merge is tried first
+func (m *Merger) mergeInto(ctx context.Context, inputs []*sql.DB, output *sql.DB, incremental bool) error {
+	if incremental {
+		done, err := m.mergeIncremental(ctx, inputs, output)
+		if err != nil || done {
+			return err
+		}
+		m.printf("no watermarks stored for all inputs (or their IDs changed), doing a full merge\n")
+	}
+	res, err := m.merge(ctx, inputs, output)
+	if err != nil {
+		return err
+	}
+	done, err := m.reportPlan(res.plan)
+	if err != nil || done {
+		return err
+	}
+	var ids *mergedIDs
+	switch {
+	case res.output != nil:
+		ids = allocateIDs(res.merged, res.output, true)
+	case m.PreserveIDs:
+		// the first input as read, a three-way merge doesn't drop its unchanged rows from it
+		ids = allocateIDs(res.merged, res.inputs[0], false)
+	default:
+		ids = allocateIDs(res.merged, nil, false)
+	}
+	var mappings []IDMapping
+	if m.IDMap != nil || m.IDMapTable != "" {
+		mappings = ids.mappings(res.inputs)
+	}
+	if m.IDMapTable != "" {
+		err = createIDMapTable(ctx, output, m.IDMapTable)
+		if err != nil {
+			return err
+		}
+	}
+	var watermarkKeys []string
+	if m.Incremental {
+		watermarkKeys, err = m.inputKeys(len(inputs))
+		if err != nil {
+			return err
+		}
+		err = createWatermarkTable(ctx, output)
+		if err != nil {
+			return err
+		}
+	}
+	err = m.writeDatabase(ctx, output, func(ctx context.Context, tx *sql.Tx) error {
+		var err error
+		if res.output != nil {
+			err = m.writeDiff(ctx, tx, res.output, res.merged, ids)
+		} else {
+			err = m.writeTables(ctx, tx, res.merged, ids)
+		}
+		if err != nil {
+			return err
+		}
+		if m.IDMapTable != "" {
+			err = m.writeIDMap(ctx, tx, m.IDMapTable, mappings)
+			if err != nil {
+				return err
+			}
+		}
+		if m.Incremental {
+			return m.writeWatermarks(ctx, tx, watermarkKeys, newWatermarks(res.inputs, nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if m.IDMap != nil {
+		return WriteIDMapCSV(m.IDMap, mappings)
+	}
+	return nil
+}
+
+// reportPlan writes conflicts reports, in dry-run mode it prints the plan
+// It returns true when nothing should be written (dry run or exported conflicts)
+func (m *Merger) reportPlan(plan *Plan) (bool, error) {
+	err := m.writeReports(plan)
+	if err != nil {
+		return true, err
+	}
+	if m.ExportConflicts != nil {
+		m.printf("conflicts exported, databases not written\n")
+		return true, nil
+	}
+	if m.DryRun {
+		if m.Out == nil {
+			return true, nil
+		}
+		return true, plan.Print(m.Out)
+	}
+	return false, nil
+}
+
+// MergePlan merges input databases without writing anything and returns the merge plan
+func (m *Merger) MergePlan(ctx context.Context, inputs []*sql.DB) (*Plan, error) {
+	res, err := m.merge(ctx, inputs, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.plan, nil
+}
+
+// mergeResult holds merged data, data read from all databases and the merge plan
+type mergeResult struct {
+	merged *snapshot
+	inputs []*snapshot // as read, never modified by the merge
+	output *snapshot   // output database contents before the merge, upsert only
+	plan   *Plan
+}
+
+// merge reads and merges all inputs (using the base database if set, and the output database when upserting)
+func (m *Merger) merge(ctx context.Context, inputs []*sql.DB, output *sql.DB) (*mergeResult, error) {
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no input databases given")
+	}
+	if m.Upsert && (output == nil || m.Base != nil || m.PreserveIDs) {
+		return nil, fmt.Errorf("upsert needs the output database and cannot be combined with a three-way merge or preserving IDs")
+	}
+	order, err := m.priorityOrder(len(inputs))
+	if err != nil {
+		return nil, err
+	}
+	dbs := append([]*sql.DB{}, inputs...)
+	var dbNums []int
+	for i := range inputs {
+		dbNums = append(dbNums, i+1)
+	}
+	if m.Base != nil {
+		dbs = append(dbs, m.Base)
+		dbNums = append(dbNums, BaseDB)
+	}
+	if m.Upsert {
+		dbs = append(dbs, output)
+		dbNums = append(dbNums, OutputDB)
+	}
+	srcs, err := m.loadDatabases(ctx, dbs, dbNums, loadTables)
+	if err != nil {
+		return nil, err
+	}
+	res := &mergeResult{inputs: srcs[:len(inputs)]}
+	var base *snapshot
+	if m.Base != nil {
+		base = srcs[len(inputs)]
+	}
+	resolver, export, err := m.conflictsResolver(res.inputs, base)
+	if err != nil {
+		return nil, err
+	}
+	sources := res.inputs
+	if m.Upsert {
+		// output database is merged as the last source, at its priority
+		res.output = srcs[len(srcs)-1]
+		sources = append(append([]*snapshot{}, res.inputs...), res.output)
+		order, err = m.upsertOrder(order, len(inputs))
+		if err != nil {
+			return nil, err
+		}
+	}
+	srcNums := append([]int{}, dbNums[:len(inputs)]...)
+	if res.output != nil {
+		srcNums = append(srcNums, OutputDB)
+	}
+	res.plan = newPlan(srcNums)
+	if base != nil {
+		sources = m.threeWay(base, res.inputs, order, res.plan)
+	}
+	res.merged, err = m.mergeSnapshots(sources, order, res.plan, resolver)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		all := []*snapshot{}
+		for _, i := range order {
+			all = append(all, res.inputs[i])
+		}
+		m.restoreReferenced(res.merged, append(all, base))
+		res.plan.countDeleted(base, res.merged)
+	}
+	if res.output != nil {
+		pruneOutputOnly(res.merged, res.inputs)
+		res.plan.countDeleted(res.output, res.merged)
+	}
+	res.plan.countRows(res.merged)
+	res.plan.sortConflicts()
+	if export != nil {
+		export.sort()
+		err = export.Write(m.ExportConflicts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// conflictsResolver returns resolver used for merging: m.Resolver, or choices from m.ApplyConflicts
+// When m.ExportConflicts is set, it also returns the conflicts file collecting all conflicts
+func (m *Merger) conflictsResolver(srcs []*snapshot, base *snapshot) (Resolver, *ConflictsFile, error) {
+	if m.ApplyConflicts == nil && m.ExportConflicts == nil {
+		return m.Resolver, nil, nil
+	}
+	var checksums []string
+	for _, s := range srcs {
+		checksums = append(checksums, s.checksum())
+	}
+	if base != nil {
+		checksums = append(checksums, base.checksum())
+	}
+	resolver := m.Resolver
+	if m.ApplyConflicts != nil {
+		err := checkChecksums(m.ApplyConflicts, checksums, len(srcs))
+		if err != nil {
+			return nil, nil, err
+		}
+		m.printf("applying %d conflict resolutions from conflicts file\n", len(m.ApplyConflicts.Conflicts))
+		resolver = newFileResolver(m.ApplyConflicts)
+	}
+	if m.ExportConflicts == nil {
+		return resolver, nil, nil
+	}
+	export := &exportResolver{next: resolver, file: &ConflictsFile{Checksums: checksums}}
+	return export, export.file, nil
+}
+
+// ParsePriority parses comma separated list of 1-based input database numbers, like "2,1,3"
+func ParsePriority(s string) ([]int, error) {
+	var priority []int
+	for _, item := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority '%s': %w", s, err)
+		}
+		priority = append(priority, n)
+	}
+	return priority, nil
+}
+
+// priorityOrder returns 0-based indices of n inputs from the highest to the lowest priority
+func (m *Merger) priorityOrder(n int) ([]int, error) {
+	order := make([]int, n)
+	if m.Priority == nil {
+		for i := range order {
+			order[i] = i
+		}
+		return order, nil
+	}
+	if len(m.Priority) != n {
+		return nil, fmt.Errorf("priority %v must list all %d input databases", m.Priority, n)
+	}
+	seen := make(map[int]struct{})
+	for i, dbNum := range m.Priority {
+		_, dup := seen[dbNum]
+		if dbNum < 1 || dbNum > n || dup {
+			return nil, fmt.Errorf("priority %v must be a permutation of 1..%d", m.Priority, n)
+		}
+		seen[dbNum] = struct{}{}
+		order[i] = dbNum - 1
+	}
+	return order, nil
+}
+
+func (m *Merger) printf(f string, a ...interface{}) {
+	if m.Out == nil {
+		return
+	}
+	fmt.Fprintf(m.Out, f, a...)
+}
+
+// ordinal returns "1st", "2nd", "3rd", "4th", ... for n
+func ordinal(n int) string {
+	suffix := "th"
+	switch n % 10 {
+	case 1:
+		suffix = "st"
+	case 2:
+		suffix = "nd"
+	case 3:
+		suffix = "rd"
+	}
+	if n%100 >= 11 && n%100 <= 13 {
+		suffix = "th"
+	}
+	return strconv.Itoa(n) + suffix
+}
+
+// dbName returns a human readable name of dbNum database
+func dbName(dbNum int) string {
+	switch dbNum {
+	case OutputDB:
+		return "output database"
+	case BaseDB:
+		return "base database"
+	}
+	return ordinal(dbNum) + " input database"
+}
+
+// srcName returns a short name of dbNum database used in messages and plans: "1st", "2nd", ... for inputs, "output" or "base"
+func srcName(dbNum int) string {
+	switch dbNum {
+	case OutputDB:
+		return "output"
+	case BaseDB:
+		return "base"
+	}
+	return ordinal(dbNum)
+}
+
+// missingIn returns names of sources not having a given row, dbNums are their database numbers and has reports if i-th source has it
+func missingIn(dbNums []int, has func(i int) bool) string {
+	var missing []string
+	for i, dbNum := range dbNums {
+		if !has(i) {
+			missing = append(missing, srcName(dbNum))
+		}
+	}
+	return strings.Join(missing, ", ")
+}
+
+// joinRules returns unique rules that resolved a conflict
+func joinRules(rules []string) string {
+	seen := make(map[string]struct{})
+	var unique []string
+	for _, rule := range rules {
+		for _, r := range strings.Split(rule, ", ") {
+			if _, ok := seen[r]; ok || r == "" {
+				continue
+			}
+			seen[r] = struct{}{}
+			unique = append(unique, r)
+		}
+	}
+	sort.Strings(unique)
+	return strings.Join(unique, ", ")
+}
+
+// newer returns the later of t1 and modified if s has uuid unique identity, t1 otherwise
+func newer(t1 *time.Time, s *snapshot, uuid string) *time.Time {
+	modified, ok := s.uidentities[uuid]
+	if !ok || t1 != nil && !modified.After(*t1) {
+		return t1
+	}
+	return &modified
+}
+
+// mergeSnapshots merges all inputs, order lists inputs from the highest to the lowest priority
+// It records rows taken from each input, merged rows and conflicts in plan
+// Conflicting fields are resolved using m.Policies, a field with the "fail" policy returns ErrConflict
+// then resolver (if not nil) chooses between the row merged so far, the input row and the row merged using policies
+// Rows of every input are merged in keys order, so conflicts are resolved (and prompted for) in the same order in every run
+func (m *Merger) mergeSnapshots(srcs []*snapshot, order []int, plan *Plan, resolver Resolver) (*snapshot, error) {
+	dbg := m.Debug
+	ps := m.Policies
+	// database numbers of srcs, the output database is merged as a source when upserting
+	dbNums := plan.DBs
+	merged := newSnapshot()
+	m.printf("countries...\n")
+	tp := plan.table("countries")
+	from := make(map[string]int)
+	seen := make(map[string]int)
+	conflicts := make(map[string][]string)
+	for _, i := range order {
+		codes := make([]string, 0, len(srcs[i].countries))
+		for code := range srcs[i].countries {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			c := srcs[i].countries[code]
+			seen[code]++
+			mc, ok := merged.countries[code]
+			if !ok {
+				merged.countries[code] = c
+				from[code] = i
+				tp.Added[i]++
+				if dbg {
+					missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].countries[code]; return ok })
+					if missing != "" {
+						m.printf("Country from %s (%+v) missing in %s, adding\n", srcName(dbNums[i]), c, missing)
+					}
+				}
+				continue
+			}
+			if seen[code] == 2 {
+				tp.Merged++
+			}
+			if c.Name != mc.Name || c.Alpha3 != mc.Alpha3 {
+				m.printf("Country from %s (%+v) different in %s (%+v), merging\n", srcName(dbNums[i]), c, srcName(dbNums[from[code]]), mc)
+				resolved, rule, err := ps.mergeCountries(&mc, &c, dbNums[i])
+				if err != nil {
+					return nil, err
+				}
+				choice, rule, err := resolve(resolver, &PairConflict{Table: "countries", Key: code, DB1: dbNums[from[code]], DB2: dbNums[i], First: mc.String(), Second: c.String(), Merged: resolved.String(), Rule: rule})
+				if err != nil {
+					return nil, err
+				}
+				switch choice {
+				case ChooseFirst:
+					resolved = mc
+				case ChooseSecond:
+					resolved = c
+				}
+				merged.countries[code] = resolved
+				conflicts[code] = append(conflicts[code], rule)
+			}
+		}
+	}
+	for code, rules := range conflicts {
+		tp.addConflict(dbNums, code, order, func(i int) (string, bool) { c, ok := srcs[i].countries[code]; return c.String(), ok }, merged.countries[code].String(), joinRules(rules))
+	}
+	m.printf("organizations...\n")
+	tp = plan.table("organizations")
+	seen = make(map[string]int)
+	for _, i := range order {
+		for lName, name := range srcs[i].orgNames {
+			seen[lName]++
+			_, ok := merged.orgNames[lName]
+			if ok {
+				if seen[lName] == 2 {
+					tp.Merged++
+				}
+				continue
+			}
+			merged.orgNames[lName] = name
+			tp.Added[i]++
+			if dbg {
+				missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].orgNames[lName]; return ok })
+				if missing != "" {
+					m.printf("Organization from %s (name=%s) missing in %s, adding\n", srcName(dbNums[i]), name, missing)
+				}
+			}
+		}
+	}
+	m.printf("domains_organizations...\n")
+	tp = plan.table("domains_organizations")
+	from = make(map[string]int)
+	seen = make(map[string]int)
+	conflicts = make(map[string][]string)
+	for _, i := range order {
+		lDomains := make([]string, 0, len(srcs[i].domains))
+		for lDomain := range srcs[i].domains {
+			lDomains = append(lDomains, lDomain)
+		}
+		sort.Strings(lDomains)
+		for _, lDomain := range lDomains {
+			do := srcs[i].domains[lDomain]
+			seen[lDomain]++
+			mdo, ok := merged.domains[lDomain]
+			if ok {
+				if seen[lDomain] == 2 {
+					tp.Merged++
+				}
+				if do.IsTopDomain != mdo.IsTopDomain || !strings.EqualFold(do.OrgName, mdo.OrgName) {
+					m.printf("Domain-Organization from %s (%+v) different in %s (%+v), merging\n", srcName(dbNums[i]), do, srcName(dbNums[from[lDomain]]), mdo)
+					resolved, rule, err := ps.mergeDomains(&mdo, &do, dbNums[i])
+					if err != nil {
+						return nil, err
+					}
+					choice, rule, err := resolve(resolver, &PairConflict{Table: "domains_organizations", Key: lDomain, DB1: dbNums[from[lDomain]], DB2: dbNums[i], First: mdo.String(), Second: do.String(), Merged: resolved.String(), Rule: rule})
+					if err != nil {
+						return nil, err
+					}
+					switch choice {
+					case ChooseFirst:
+						resolved = mdo
+					case ChooseSecond:
+						resolved = do
+					}
+					merged.domains[lDomain] = resolved
+					conflicts[lDomain] = append(conflicts[lDomain], rule)
+				}
+				continue
+			}
+			merged.domains[lDomain] = do
+			from[lDomain] = i
+			tp.Added[i]++
+			if dbg {
+				missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].domains[lDomain]; return ok })
+				if missing != "" {
+					m.printf("Domain-Organization from %s (id=%d, domain=%s, %+v) missing in %s, adding\n", srcName(dbNums[i]), do.ID, do.Domain, do, missing)
+				}
+			}
+		}
+	}
+	for lDomain, rules := range conflicts {
+		tp.addConflict(dbNums, lDomain, order, func(i int) (string, bool) { do, ok := srcs[i].domains[lDomain]; return do.String(), ok }, merged.domains[lDomain].String(), joinRules(rules))
+	}
+	m.printf("matching_blacklist...\n")
+	tp = plan.table("matching_blacklist")
+	seen = make(map[string]int)
+	for _, i := range order {
+		for lBl, bl := range srcs[i].blacklist {
+			seen[lBl]++
+			_, ok := merged.blacklist[lBl]
+			if !ok {
+				merged.blacklist[lBl] = bl
+				tp.Added[i]++
+			} else if seen[lBl] == 2 {
+				tp.Merged++
+			}
+		}
+	}
+	m.printf("uidentities...\n")
+	tp = plan.table("uidentities")
+	seen = make(map[string]int)
+	for _, i := range order {
+		for uuid, modified := range srcs[i].uidentities {
+			seen[uuid]++
+			mModified, ok := merged.uidentities[uuid]
+			if !ok {
+				tp.Added[i]++
+			} else if seen[uuid] == 2 {
+				tp.Merged++
+			}
+			if !ok || modified.After(mModified) {
+				merged.uidentities[uuid] = modified
+			}
+		}
+	}
+	m.printf("profiles...\n")
+	tp = plan.table("profiles")
+	from = make(map[string]int)
+	seen = make(map[string]int)
+	conflicts = make(map[string][]string)
+	modified := make(map[string]*time.Time)
+	for _, i := range order {
+		uuids := make([]string, 0, len(srcs[i].profiles))
+		for uuid := range srcs[i].profiles {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
+		for _, uuid := range uuids {
+			p := srcs[i].profiles[uuid]
+			seen[uuid]++
+			mp, ok := merged.profiles[uuid]
+			if !ok {
+				merged.profiles[uuid] = p
+				from[uuid] = i
+				modified[uuid] = newer(nil, srcs[i], uuid)
+				tp.Added[i]++
+				if dbg {
+					missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].profiles[uuid]; return ok })
+					if missing != "" {
+						m.printf("Profile from %s (%+v) missing in %s, adding\n", srcName(dbNums[i]), p, missing)
+					}
+				}
+				continue
+			}
+			if seen[uuid] == 2 {
+				tp.Merged++
+			}
+			if ProfilesDiffer(&mp, &p) {
+				m.printf("Profile from %s (%+v) different in %s (%+v), merging\n", srcName(dbNums[i]), p, srcName(dbNums[from[uuid]]), mp)
+				var t2 *time.Time
+				if t, ok := srcs[i].uidentities[uuid]; ok {
+					t2 = &t
+				}
+				resolved, rule, err := ps.mergeProfiles(&mp, &p, modified[uuid], t2, dbNums[i])
+				if err != nil {
+					return nil, err
+				}
+				choice, rule, err := resolve(resolver, &PairConflict{Table: "profiles", Key: uuid, DB1: dbNums[from[uuid]], DB2: dbNums[i], First: mp.String(), Second: p.String(), Merged: resolved.String(), Rule: rule})
+				if err != nil {
+					return nil, err
+				}
+				switch choice {
+				case ChooseFirst:
+					resolved = mp
+				case ChooseSecond:
+					resolved = p
+				}
+				merged.profiles[uuid] = resolved
+				conflicts[uuid] = append(conflicts[uuid], rule)
+			}
+			modified[uuid] = newer(modified[uuid], srcs[i], uuid)
+		}
+	}
+	for uuid, rules := range conflicts {
+		tp.addConflict(dbNums, uuid, order, func(i int) (string, bool) { p, ok := srcs[i].profiles[uuid]; return p.String(), ok }, merged.profiles[uuid].String(), joinRules(rules))
+	}
+	m.printf("identities...\n")
+	tp = plan.table("identities")
+	from = make(map[string]int)
+	seen = make(map[string]int)
+	conflicts = make(map[string][]string)
+	for _, i := range order {
+		identityIDs := make([]string, 0, len(srcs[i].identities))
+		for id := range srcs[i].identities {
+			identityIDs = append(identityIDs, id)
+		}
+		sort.Strings(identityIDs)
+		for _, id := range identityIDs {
+			iy := srcs[i].identities[id]
+			seen[id]++
+			mi, ok := merged.identities[id]
+			if !ok {
+				merged.identities[id] = iy
+				from[id] = i
+				tp.Added[i]++
+				if dbg {
+					missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].identities[id]; return ok })
+					if missing != "" {
+						m.printf("Identity from %s (%+v) missing in %s, adding\n", srcName(dbNums[i]), iy, missing)
+					}
+				}
+				continue
+			}
+			if seen[id] == 2 {
+				tp.Merged++
+			}
+			if IdentitiesDiffer(&mi, &iy) {
+				m.printf("Identity from %s (%+v) different in %s (%+v), merging\n", srcName(dbNums[i]), iy, srcName(dbNums[from[id]]), mi)
+				resolved, rule, err := ps.mergeIdentities(&mi, &iy, dbNums[i])
+				if err != nil {
+					return nil, err
+				}
+				choice, rule, err := resolve(resolver, &PairConflict{Table: "identities", Key: id, DB1: dbNums[from[id]], DB2: dbNums[i], First: mi.String(), Second: iy.String(), Merged: resolved.String(), Rule: rule})
+				if err != nil {
+					return nil, err
+				}
+				switch choice {
+				case ChooseFirst:
+					resolved = mi
+				case ChooseSecond:
+					resolved = iy
+				}
+				merged.identities[id] = resolved
+				conflicts[id] = append(conflicts[id], rule)
+			}
+		}
+	}
+	for id, rules := range conflicts {
+		tp.addConflict(dbNums, id, order, func(i int) (string, bool) { iy, ok := srcs[i].identities[id]; return iy.String(), ok }, merged.identities[id].String(), joinRules(rules))
+	}
+	m.printf("enrollments...\n")
+	tp = plan.table("enrollments")
+	eFrom := make(map[EnrollmentKey]int)
+	eSeen := make(map[EnrollmentKey]int)
+	eConflicts := make(map[EnrollmentKey][]string)
+	eModified := make(map[EnrollmentKey]*time.Time)
+	for _, i := range order {
+		for _, k := range sortedEnrollmentKeys(srcs[i].enrollments) {
+			e := srcs[i].enrollments[k]
+			eSeen[k]++
+			me, ok := merged.enrollments[k]
+			if !ok {
+				merged.enrollments[k] = e
+				eFrom[k] = i
+				eModified[k] = newer(nil, srcs[i], k.UUID)
+				tp.Added[i]++
+				if dbg {
+					missing := missingIn(dbNums, func(j int) bool { _, ok := srcs[j].enrollments[k]; return ok })
+					if missing != "" {
+						m.printf("Enrollment from %s (%+v) missing in %s, adding\n", srcName(dbNums[i]), e, missing)
+					}
+				}
+				continue
+			}
+			if eSeen[k] == 2 {
+				tp.Merged++
+			}
+			if EnrollmentsDiffer(&me, &e) {
+				m.printf("Enrollment from %s (%+v) different in %s (%+v), merging\n", srcName(dbNums[i]), e, srcName(dbNums[eFrom[k]]), me)
+				var t2 *time.Time
+				if t, ok := srcs[i].uidentities[k.UUID]; ok {
+					t2 = &t
+				}
+				resolved, rule, err := ps.mergeEnrollments(&me, &e, eModified[k], t2, dbNums[i])
+				if err != nil {
+					return nil, err
+				}
+				choice, rule, err := resolve(resolver, &PairConflict{Table: "enrollments", Key: k.String(), DB1: dbNums[eFrom[k]], DB2: dbNums[i], First: me.String(), Second: e.String(), Merged: resolved.String(), Rule: rule})
+				if err != nil {
+					return nil, err
+				}
+				switch choice {
+				case ChooseFirst:
+					resolved = me
+				case ChooseSecond:
+					resolved = e
+				}
+				merged.enrollments[k] = resolved
+				eConflicts[k] = append(eConflicts[k], rule)
+			}
+			eModified[k] = newer(eModified[k], srcs[i], k.UUID)
+		}
+	}
+	for k, rules := range eConflicts {
+		tp.addConflict(dbNums, k.String(), order, func(i int) (string, bool) { e, ok := srcs[i].enrollments[k]; return e.String(), ok }, merged.enrollments[k].String(), joinRules(rules))
+	}
+	m.mergeArchives(srcs, order, plan, merged)
+	return merged, nil
+}
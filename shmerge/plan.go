@@ -0,0 +1,192 @@
+package shmerge
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RuleKeepModified is reported for rows deleted in some inputs and modified in others, they are kept
+// Other conflicts report "field:policy" rules of all fields that differ, see Policies
+const RuleKeepModified = "keep-modified"
+
+const deletedStr string = "<deleted>"
+
+// ConflictSource holds a conflicting row version from a single database
+type ConflictSource struct {
+	DB    int    `json:"db"`    // 1-based input database number, BaseDB or OutputDB (upsert)
+	Value string `json:"value"` // row as returned by String(), "<deleted>" for rows deleted since the base
+}
+
+// Conflict describes a row that differs between inputs and how it was resolved
+type Conflict struct {
+	Table   string           `json:"table"`
+	Key     string           `json:"key"`
+	Sources []ConflictSource `json:"sources"`
+	Chosen  string           `json:"chosen"` // merged row
+	Rule    string           `json:"rule"`   // rules that decided the merged row
+}
+
+// TablePlan holds merge statistics of a single table
+type TablePlan struct {
+	Table     string
+	Rows      int   // rows in the merged table
+	Added     []int // rows taken from each source (indexed like Plan.DBs), because it is the highest priority source having them
+	Merged    int   // rows present in more than one input
+	Deleted   int   // rows from the base (or the output when upserting) database deleted in the merged table
+	Conflicts []Conflict
+}
+
+// Plan describes what a merge does with every table
+type Plan struct {
+	DBs    []int // database numbers of merged sources: 1-based input numbers, followed by OutputDB when upserting
+	Tables []*TablePlan
+}
+
+// newPlan returns an empty plan for sources with given database numbers
+func newPlan(dbNums []int) *Plan {
+	p := &Plan{DBs: dbNums}
+	for _, table := range mergedTables {
+		p.Tables = append(p.Tables, &TablePlan{Table: table, Added: make([]int, len(dbNums))})
+	}
+	return p
+}
+
+// table returns plan for a given table
+func (p *Plan) table(name string) *TablePlan {
+	for _, tp := range p.Tables {
+		if tp.Table == name {
+			return tp
+		}
+	}
+	tp := &TablePlan{Table: name}
+	p.Tables = append(p.Tables, tp)
+	return tp
+}
+
+// Conflicts returns all conflicts from all tables
+func (p *Plan) Conflicts() []Conflict {
+	var conflicts []Conflict
+	for _, tp := range p.Tables {
+		conflicts = append(conflicts, tp.Conflicts...)
+	}
+	return conflicts
+}
+
+// addConflict records a conflict for a row key, value returns i-th source version of a row and reports if it has the row
+// dbNums are database numbers of sources
+func (tp *TablePlan) addConflict(dbNums []int, key string, order []int, value func(i int) (string, bool), chosen, rule string) {
+	c := Conflict{Table: tp.Table, Key: key, Chosen: chosen, Rule: rule}
+	for _, i := range order {
+		v, ok := value(i)
+		if ok {
+			c.Sources = append(c.Sources, ConflictSource{DB: dbNums[i], Value: v})
+		}
+	}
+	tp.Conflicts = append(tp.Conflicts, c)
+}
+
+// countRows sets number of rows of every merged table
+func (p *Plan) countRows(merged *snapshot) {
+	p.table("countries").Rows = len(merged.countries)
+	p.table("organizations").Rows = len(merged.orgNames)
+	p.table("domains_organizations").Rows = len(merged.domains)
+	p.table("matching_blacklist").Rows = len(merged.blacklist)
+	p.table("uidentities").Rows = len(merged.uidentities)
+	p.table("profiles").Rows = len(merged.profiles)
+	p.table("identities").Rows = len(merged.identities)
+	p.table("enrollments").Rows = len(merged.enrollments)
+	p.table("uidentities_archive").Rows = len(merged.uidentitiesArchive)
+	p.table("profiles_archive").Rows = len(merged.profilesArchive)
+	p.table("identities_archive").Rows = len(merged.identitiesArchive)
+	p.table("enrollments_archive").Rows = len(merged.enrollmentsArchive)
+}
+
+// countDeleted counts rows from the base database missing in the merged data
+func (p *Plan) countDeleted(base, merged *snapshot) {
+	for code := range base.countries {
+		if _, ok := merged.countries[code]; !ok {
+			p.table("countries").Deleted++
+		}
+	}
+	for lName := range base.orgNames {
+		if _, ok := merged.orgNames[lName]; !ok {
+			p.table("organizations").Deleted++
+		}
+	}
+	for lDomain := range base.domains {
+		if _, ok := merged.domains[lDomain]; !ok {
+			p.table("domains_organizations").Deleted++
+		}
+	}
+	for lBl := range base.blacklist {
+		if _, ok := merged.blacklist[lBl]; !ok {
+			p.table("matching_blacklist").Deleted++
+		}
+	}
+	for uuid := range base.uidentities {
+		if _, ok := merged.uidentities[uuid]; !ok {
+			p.table("uidentities").Deleted++
+		}
+	}
+	for uuid := range base.profiles {
+		if _, ok := merged.profiles[uuid]; !ok {
+			p.table("profiles").Deleted++
+		}
+	}
+	for id := range base.identities {
+		if _, ok := merged.identities[id]; !ok {
+			p.table("identities").Deleted++
+		}
+	}
+	for k := range base.enrollments {
+		if _, ok := merged.enrollments[k]; !ok {
+			p.table("enrollments").Deleted++
+		}
+	}
+}
+
+// sortConflicts sorts conflicts of every table by key
+func (p *Plan) sortConflicts() {
+	for _, tp := range p.Tables {
+		sort.SliceStable(tp.Conflicts, func(i, j int) bool { return tp.Conflicts[i].Key < tp.Conflicts[j].Key })
+	}
+}
+
+// Print writes human readable plan to w
+func (p *Plan) Print(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Merge plan:\n")
+	if err != nil {
+		return err
+	}
+	for _, tp := range p.Tables {
+		var added []string
+		for i, n := range tp.Added {
+			dbNum := i + 1
+			if i < len(p.DBs) {
+				dbNum = p.DBs[i]
+			}
+			added = append(added, fmt.Sprintf("%s: %d", srcName(dbNum), n))
+		}
+		s := fmt.Sprintf("%s: %d rows, added from %s, merged: %d", tp.Table, tp.Rows, strings.Join(added, ", "), tp.Merged)
+		if tp.Deleted > 0 {
+			s += fmt.Sprintf(", deleted: %d", tp.Deleted)
+		}
+		_, err = fmt.Fprintf(w, "%s, conflicts: %d\n", s, len(tp.Conflicts))
+		if err != nil {
+			return err
+		}
+		for _, c := range tp.Conflicts {
+			var srcs []string
+			for _, src := range c.Sources {
+				srcs = append(srcs, dbName(src.DB)+": "+src.Value)
+			}
+			_, err = fmt.Fprintf(w, "  %s: %s -> %s (%s)\n", c.Key, strings.Join(srcs, ", "), c.Chosen, c.Rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
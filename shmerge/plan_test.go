@@ -0,0 +1,39 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestUpsertPlanNamesOutput(t *testing.T) {
+	var out bytes.Buffer
+	m := testMerger()
+	m.Out = &out
+	m.Upsert = true
+	m.DryRun = true
+	var reports bytes.Buffer
+	m.ConflictsCSV = &reports
+	err := m.Merge(context.Background(), []*sql.DB{openTestDump(t, testBase)}, openTestDump(t, testCased))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "2nd") {
+		t.Fatalf("output database called an input:\n%s", out.String())
+	}
+	for _, want := range []string{
+		"Profile from output ({uuid:u2",
+		"profiles: 2 rows, added from 1st: 2, output: 1, merged: 1",
+		"u2: 1st input database: {uuid:u2",
+		", output database: {uuid:u2",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("%q missing in:\n%s", want, out.String())
+		}
+	}
+	if !strings.Contains(reports.String(), "profiles,u2,-1,") {
+		t.Fatalf("output database number missing in conflicts report:\n%s", reports.String())
+	}
+}
@@ -0,0 +1,417 @@
+package shmerge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Policy is a conflict resolution policy of a single field
+type Policy string
+
+// Conflict resolution policies
+const (
+	PreferFirst    Policy = "prefer-first"    // value from the higher priority input
+	PreferSecond   Policy = "prefer-second"   // value from the lower priority input
+	PreferNewest   Policy = "prefer-newest"   // value from the more recently modified row, prefer-non-null if modification dates are unknown
+	PreferNonNull  Policy = "prefer-non-null" // first non-null value in priority order
+	PreferLongest  Policy = "prefer-longest"  // longest value, first in priority order if lengths are equal
+	PreferAccurate Policy = "prefer-accurate" // profiles gender and gender_acc only: value from the profile with higher gender_acc, prefer-non-null otherwise
+	Fail           Policy = "fail"            // different values fail the merge
+)
+
+// TablePolicy holds conflict resolution policies of a single table
+type TablePolicy struct {
+	Default Policy            `json:"default,omitempty" yaml:"default,omitempty"` // used for fields not listed in Fields
+	Fields  map[string]Policy `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// Policies holds conflict resolution policies per table, tables not listed use default policies
+type Policies map[string]TablePolicy
+
+// policyFields lists fields that can have policies for each table
+var policyFields = map[string][]string{
+	"countries":             {"name", "alpha3"},
+	"domains_organizations": {"is_top_domain", "organization"},
+	"profiles":              {"name", "email", "gender", "gender_acc", "is_bot", "country_code"},
+	"identities":            {"name", "email", "username", "source", "uuid", "last_modified"},
+	"enrollments":           {"organization"},
+}
+
+// DefaultPolicies returns policies used when no configuration is given
+func DefaultPolicies() Policies {
+	return Policies{
+		"countries":             {Default: PreferFirst},
+		"domains_organizations": {Default: PreferFirst},
+		"profiles":              {Default: PreferNonNull, Fields: map[string]Policy{"gender": PreferAccurate, "gender_acc": PreferAccurate}},
+		"identities":            {Default: PreferNonNull, Fields: map[string]Policy{"source": PreferNewest, "last_modified": PreferNewest}},
+		"enrollments":           {Default: PreferFirst},
+	}
+}
+
+// ParsePolicies parses YAML or JSON policies configuration like:
+// {"profiles": {"default": "prefer-newest", "fields": {"gender": "prefer-accurate"}}, "countries": {"default": "fail"}}
+func ParsePolicies(data []byte) (Policies, error) {
+	var ps Policies
+	err := yaml.UnmarshalStrict(data, &ps)
+	if err != nil {
+		return nil, err
+	}
+	return ps, ps.Validate()
+}
+
+// LoadPolicies reads YAML or JSON policies configuration from a file
+func LoadPolicies(path string) (Policies, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicies(data)
+}
+
+// Validate checks that all tables, fields and policies are known
+func (ps Policies) Validate() error {
+	check := func(table, field string, pol Policy) error {
+		where := table
+		if field != "" {
+			where += " " + field
+		}
+		switch pol {
+		case PreferFirst, PreferSecond, PreferNewest, PreferNonNull, PreferLongest, Fail:
+			return nil
+		case PreferAccurate:
+			if table == "profiles" && (field == "" || field == "gender" || field == "gender_acc") {
+				return nil
+			}
+			return fmt.Errorf("%s policy can only be used for profiles gender and gender_acc, not %s", pol, where)
+		}
+		return fmt.Errorf("unknown policy '%s' for %s", pol, where)
+	}
+	for table, tp := range ps {
+		fields, ok := policyFields[table]
+		if !ok {
+			return fmt.Errorf("policies cannot be set for table '%s'", table)
+		}
+		if tp.Default != "" {
+			err := check(table, "", tp.Default)
+			if err != nil {
+				return err
+			}
+		}
+		for field, pol := range tp.Fields {
+			known := false
+			for _, f := range fields {
+				if f == field {
+					known = true
+					break
+				}
+			}
+			if !known {
+				return fmt.Errorf("unknown field '%s' in table '%s' policies", field, table)
+			}
+			err := check(table, field, pol)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// policy returns policy for a table field: configured field policy, configured table default,
+// default field policy and default table policy are checked in that order
+func (ps Policies) policy(table, field string) Policy {
+	tp := ps[table]
+	if pol, ok := tp.Fields[field]; ok {
+		return pol
+	}
+	if tp.Default != "" {
+		return tp.Default
+	}
+	def := DefaultPolicies()[table]
+	if pol, ok := def.Fields[field]; ok {
+		return pol
+	}
+	return def.Default
+}
+
+// fieldValue holds a single field value from one of merged rows
+type fieldValue struct {
+	null     bool
+	str      string     // value as string, used for comparing and for prefer-longest
+	modified *time.Time // row modification date if known, used for prefer-newest
+}
+
+func strField(s *string, modified *time.Time) fieldValue {
+	if s == nil {
+		return fieldValue{null: true, modified: modified}
+	}
+	return fieldValue{str: *s, modified: modified}
+}
+
+func intField(i *int64, modified *time.Time) fieldValue {
+	if i == nil {
+		return fieldValue{null: true, modified: modified}
+	}
+	return fieldValue{str: strconv.FormatInt(*i, 10), modified: modified}
+}
+
+func boolField(i *int, modified *time.Time) fieldValue {
+	if i == nil {
+		return fieldValue{null: true, modified: modified}
+	}
+	return fieldValue{str: strconv.Itoa(*i), modified: modified}
+}
+
+func (v fieldValue) differs(v2 fieldValue) bool {
+	return v.null != v2.null || v.str != v2.str
+}
+
+// choose returns true if the second value should be used, v1 comes from the higher priority input
+// PreferAccurate is handled by the caller
+func (pol Policy) choose(v1, v2 fieldValue) (bool, error) {
+	switch pol {
+	case PreferFirst:
+		return false, nil
+	case PreferSecond:
+		return true, nil
+	case PreferNewest:
+		if v1.modified != nil && v2.modified != nil {
+			return v2.modified.After(*v1.modified), nil
+		}
+		return v1.null && !v2.null, nil
+	case PreferLongest:
+		if v1.null || v2.null {
+			return v1.null && !v2.null, nil
+		}
+		return len(v2.str) > len(v1.str), nil
+	case Fail:
+		if v1.differs(v2) {
+			return false, ErrConflict
+		}
+		return false, nil
+	}
+	return v1.null && !v2.null, nil
+}
+
+// fieldMerger merges fields of two rows, collecting rules that decided fields with different values
+type fieldMerger struct {
+	ps    Policies
+	table string
+	dbNum int // input database of the second row, reported in errors
+	key   string
+	rules []string
+}
+
+// choose returns true if the second value of a field should be used
+func (fm *fieldMerger) choose(field string, v1, v2 fieldValue) (bool, error) {
+	if !v1.differs(v2) {
+		return false, nil
+	}
+	pol := fm.ps.policy(fm.table, field)
+	fm.rules = append(fm.rules, field+":"+string(pol))
+	second, err := pol.choose(v1, v2)
+	if err != nil {
+		return false, wrapError(fmt.Errorf("%w: %s", err, field), fm.table, fm.dbNum, "merge", fm.key)
+	}
+	return second, nil
+}
+
+// rule returns rules that decided all fields with different values
+func (fm *fieldMerger) rule() string {
+	sort.Strings(fm.rules)
+	return strings.Join(fm.rules, ", ")
+}
+
+// mergeCountries merges c2 from dbNum input into c1 field by field
+func (ps Policies) mergeCountries(c1, c2 *Country, dbNum int) (Country, string, error) {
+	fm := &fieldMerger{ps: ps, table: "countries", dbNum: dbNum, key: c1.Code}
+	c := *c1
+	second, err := fm.choose("name", fieldValue{str: c1.Name}, fieldValue{str: c2.Name})
+	if err != nil {
+		return c, "", err
+	}
+	if second {
+		c.Name = c2.Name
+	}
+	second, err = fm.choose("alpha3", fieldValue{str: c1.Alpha3}, fieldValue{str: c2.Alpha3})
+	if err != nil {
+		return c, "", err
+	}
+	if second {
+		c.Alpha3 = c2.Alpha3
+	}
+	return c, fm.rule(), nil
+}
+
+// mergeDomains merges do2 into do1 field by field
+func (ps Policies) mergeDomains(do1, do2 *DomainOrg, dbNum int) (DomainOrg, string, error) {
+	fm := &fieldMerger{ps: ps, table: "domains_organizations", dbNum: dbNum, key: do1.Domain}
+	do := *do1
+	second, err := fm.choose("is_top_domain", fieldValue{str: strconv.Itoa(do1.IsTopDomain)}, fieldValue{str: strconv.Itoa(do2.IsTopDomain)})
+	if err != nil {
+		return do, "", err
+	}
+	if second {
+		do.IsTopDomain = do2.IsTopDomain
+	}
+	second, err = fm.choose("organization", fieldValue{str: strings.ToLower(do1.OrgName)}, fieldValue{str: strings.ToLower(do2.OrgName)})
+	if err != nil {
+		return do, "", err
+	}
+	if second {
+		do.OrgID = do2.OrgID
+		do.OrgName = do2.OrgName
+	}
+	return do, fm.rule(), nil
+}
+
+// mergeEnrollments merges e2 into e1, t1 and t2 are unique identity modification dates
+func (ps Policies) mergeEnrollments(e1, e2 *Enrollment, t1, t2 *time.Time, dbNum int) (Enrollment, string, error) {
+	fm := &fieldMerger{ps: ps, table: "enrollments", dbNum: dbNum, key: EnrollmentKey{Start: e1.Start, End: e1.End, UUID: e1.UUID}.String()}
+	e := *e1
+	second, err := fm.choose("organization", fieldValue{str: strings.ToLower(e1.OrgName), modified: t1}, fieldValue{str: strings.ToLower(e2.OrgName), modified: t2})
+	if err != nil {
+		return e, "", err
+	}
+	if second {
+		e = *e2
+	}
+	return e, fm.rule(), nil
+}
+
+// mergeProfiles merges p2 into p1 field by field, t1 and t2 are unique identity modification dates
+// With default policies it works exactly like MergeProfiles
+func (ps Policies) mergeProfiles(p1, p2 *Profile, t1, t2 *time.Time, dbNum int) (Profile, string, error) {
+	fm := &fieldMerger{ps: ps, table: "profiles", dbNum: dbNum, key: p1.UUID}
+	p := *p1
+	second, err := fm.choose("name", strField(p1.Name, t1), strField(p2.Name, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.Name = p2.Name
+	}
+	second, err = fm.choose("email", strField(p1.Email, t1), strField(p2.Email, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.Email = p2.Email
+	}
+	// accurate reports if the second profile has more accurate gender
+	accurate := func(field string, v1, v2 fieldValue) (bool, error) {
+		if ps.policy("profiles", field) != PreferAccurate {
+			return fm.choose(field, v1, v2)
+		}
+		if !v1.differs(v2) {
+			return false, nil
+		}
+		fm.rules = append(fm.rules, field+":"+string(PreferAccurate))
+		if p1.GenderAcc != nil && p2.GenderAcc != nil {
+			if *p1.GenderAcc > *p2.GenderAcc && p1.Gender != nil {
+				return false, nil
+			}
+			if *p2.GenderAcc > *p1.GenderAcc && p2.Gender != nil {
+				return true, nil
+			}
+		}
+		return PreferNonNull.choose(v1, v2)
+	}
+	second, err = accurate("gender", strField(p1.Gender, t1), strField(p2.Gender, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.Gender = p2.Gender
+	}
+	second, err = accurate("gender_acc", intField(p1.GenderAcc, t1), intField(p2.GenderAcc, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.GenderAcc = p2.GenderAcc
+	}
+	second, err = fm.choose("is_bot", boolField(p1.IsBot, t1), boolField(p2.IsBot, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.IsBot = p2.IsBot
+	}
+	second, err = fm.choose("country_code", strField(p1.CountryCode, t1), strField(p2.CountryCode, t2))
+	if err != nil {
+		return p, "", err
+	}
+	if second {
+		p.CountryCode = p2.CountryCode
+	}
+	return p, fm.rule(), nil
+}
+
+// mergeIdentities merges i2 into i1 field by field, their last_modified columns are used for prefer-newest
+// With default policies it works exactly like MergeIdentities
+func (ps Policies) mergeIdentities(i1, i2 *Identity, dbNum int) (Identity, string, error) {
+	fm := &fieldMerger{ps: ps, table: "identities", dbNum: dbNum, key: i1.ID}
+	t1, t2 := i1.LastModified, i2.LastModified
+	i := *i1
+	second, err := fm.choose("name", strField(i1.Name, t1), strField(i2.Name, t2))
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.Name = i2.Name
+	}
+	second, err = fm.choose("email", strField(i1.Email, t1), strField(i2.Email, t2))
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.Email = i2.Email
+	}
+	second, err = fm.choose("username", strField(i1.Username, t1), strField(i2.Username, t2))
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.Username = i2.Username
+	}
+	second, err = fm.choose("source", fieldValue{str: i1.Source, modified: t1}, fieldValue{str: i2.Source, modified: t2})
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.Source = i2.Source
+	}
+	second, err = fm.choose("uuid", strField(i1.UUID, t1), strField(i2.UUID, t2))
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.UUID = i2.UUID
+	}
+	var lm1, lm2 fieldValue
+	if t1 == nil {
+		lm1 = fieldValue{null: true}
+	} else {
+		lm1 = fieldValue{str: t1.Format(time.RFC3339Nano), modified: t1}
+	}
+	if t2 == nil {
+		lm2 = fieldValue{null: true}
+	} else {
+		lm2 = fieldValue{str: t2.Format(time.RFC3339Nano), modified: t2}
+	}
+	second, err = fm.choose("last_modified", lm1, lm2)
+	if err != nil {
+		return i, "", err
+	}
+	if second {
+		i.LastModified = i2.LastModified
+	}
+	return i, fm.rule(), nil
+}
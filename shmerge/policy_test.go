@@ -0,0 +1,151 @@
+package shmerge
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoliciesValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		ps   Policies
+		err  string
+	}{
+		{name: "defaults", ps: DefaultPolicies()},
+		{name: "empty", ps: Policies{}},
+		{name: "table default", ps: Policies{"countries": {Default: Fail}}},
+		{name: "field", ps: Policies{"identities": {Fields: map[string]Policy{"username": PreferLongest}}}},
+		{name: "accurate profiles default", ps: Policies{"profiles": {Default: PreferAccurate}}},
+		{name: "accurate gender", ps: Policies{"profiles": {Fields: map[string]Policy{"gender_acc": PreferAccurate}}}},
+		{name: "accurate other field", ps: Policies{"profiles": {Fields: map[string]Policy{"email": PreferAccurate}}}, err: "only be used for profiles gender"},
+		{name: "accurate other table", ps: Policies{"identities": {Default: PreferAccurate}}, err: "only be used for profiles gender"},
+		{name: "unknown table", ps: Policies{"organizations": {Default: PreferFirst}}, err: "cannot be set for table 'organizations'"},
+		{name: "unknown field", ps: Policies{"countries": {Fields: map[string]Policy{"code": PreferFirst}}}, err: "unknown field 'code'"},
+		{name: "unknown policy", ps: Policies{"enrollments": {Default: "prefer-random"}}, err: "unknown policy 'prefer-random'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ps.Validate()
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePolicies(t *testing.T) {
+	ps, err := ParsePolicies([]byte(`{"profiles": {"default": "prefer-newest", "fields": {"gender": "prefer-accurate"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pol := ps.policy("profiles", "gender"); pol != PreferAccurate {
+		t.Fatalf("got %s for profiles gender", pol)
+	}
+	if pol := ps.policy("profiles", "email"); pol != PreferNewest {
+		t.Fatalf("got %s for profiles email", pol)
+	}
+	// tables not configured use defaults
+	if pol := ps.policy("identities", "source"); pol != PreferNewest {
+		t.Fatalf("got %s for identities source", pol)
+	}
+	_, err = ParsePolicies([]byte("profiles:\n  defualt: fail\n"))
+	if err == nil {
+		t.Fatal("unknown key accepted")
+	}
+}
+
+func TestPolicyChoose(t *testing.T) {
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	null := fieldValue{null: true}
+	short := fieldValue{str: "ab"}
+	long := fieldValue{str: "abc"}
+	tests := []struct {
+		pol    Policy
+		v1, v2 fieldValue
+		second bool
+		err    error
+	}{
+		{pol: PreferFirst, v1: short, v2: long},
+		{pol: PreferFirst, v1: null, v2: long},
+		{pol: PreferSecond, v1: short, v2: long, second: true},
+		{pol: PreferSecond, v1: short, v2: null, second: true},
+		{pol: PreferNonNull, v1: short, v2: long},
+		{pol: PreferNonNull, v1: null, v2: long, second: true},
+		{pol: PreferNonNull, v1: short, v2: null},
+		{pol: PreferNewest, v1: fieldValue{str: "a", modified: &t1}, v2: fieldValue{str: "b", modified: &t2}, second: true},
+		{pol: PreferNewest, v1: fieldValue{str: "a", modified: &t2}, v2: fieldValue{str: "b", modified: &t1}},
+		{pol: PreferNewest, v1: fieldValue{str: "a", modified: &t1}, v2: fieldValue{str: "b", modified: &t1}},
+		{pol: PreferNewest, v1: fieldValue{null: true, modified: &t2}, v2: fieldValue{str: "b", modified: &t1}},
+		{pol: PreferNewest, v1: null, v2: fieldValue{str: "b", modified: &t2}, second: true},
+		{pol: PreferNewest, v1: fieldValue{str: "a", modified: &t1}, v2: short},
+		{pol: PreferLongest, v1: short, v2: long, second: true},
+		{pol: PreferLongest, v1: long, v2: short},
+		{pol: PreferLongest, v1: short, v2: fieldValue{str: "cd"}},
+		{pol: PreferLongest, v1: null, v2: short, second: true},
+		{pol: PreferLongest, v1: short, v2: null},
+		{pol: Fail, v1: short, v2: short},
+		{pol: Fail, v1: short, v2: long, err: ErrConflict},
+		{pol: Fail, v1: null, v2: fieldValue{}, err: ErrConflict},
+	}
+	for _, tt := range tests {
+		second, err := tt.pol.choose(tt.v1, tt.v2)
+		if second != tt.second || !errors.Is(err, tt.err) || tt.err == nil && err != nil {
+			t.Errorf("%s.choose(%+v, %+v) = %v, %v, want %v, %v", tt.pol, tt.v1, tt.v2, second, err, tt.second, tt.err)
+		}
+	}
+}
+
+func TestMergeDefaultPolicies(t *testing.T) {
+	str := func(s string) *string { return &s }
+	i64 := func(i int64) *int64 { return &i }
+	one, zero := 1, 0
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	profiles := [][2]Profile{
+		{{UUID: "u", Name: str("A")}, {UUID: "u", Name: str("B"), Email: str("b@x.com")}},
+		{{UUID: "u", Gender: str("male"), GenderAcc: i64(50)}, {UUID: "u", Gender: str("female"), GenderAcc: i64(90)}},
+		{{UUID: "u", Gender: str("male"), GenderAcc: i64(90)}, {UUID: "u", Gender: str("female"), GenderAcc: i64(50)}},
+		{{UUID: "u", GenderAcc: i64(90)}, {UUID: "u", Gender: str("female"), GenderAcc: i64(50)}},
+		{{UUID: "u", IsBot: &zero}, {UUID: "u", IsBot: &one, CountryCode: str("PL")}},
+	}
+	for _, p := range profiles {
+		got, _, err := Policies(nil).mergeProfiles(&p[0], &p[1], nil, nil, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := MergeProfiles(&p[0], &p[1]); got.String() != want.String() {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	identities := [][2]Identity{
+		{{ID: "i", Source: "git", Name: str("A")}, {ID: "i", Source: "github", Email: str("b@x.com")}},
+		{{ID: "i", Source: "git", LastModified: &t1}, {ID: "i", Source: "github", LastModified: &t2}},
+		{{ID: "i", Source: "git", LastModified: &t2}, {ID: "i", Source: "github", LastModified: &t1}},
+		{{ID: "i", Source: "git"}, {ID: "i", Source: "github", LastModified: &t1, UUID: str("u")}},
+	}
+	for _, iy := range identities {
+		got, _, err := Policies(nil).mergeIdentities(&iy[0], &iy[1], 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := MergeIdentities(&iy[0], &iy[1]); got.String() != want.String() {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMergeFailPolicy(t *testing.T) {
+	ps := Policies{"countries": {Fields: map[string]Policy{"name": Fail}}}
+	_, rule, err := ps.mergeCountries(&Country{Code: "PL", Name: "Poland", Alpha3: "POL"}, &Country{Code: "PL", Name: "Poland", Alpha3: "PLN"}, 2)
+	if err != nil || rule != "alpha3:prefer-first" {
+		t.Fatalf("got %q, %v", rule, err)
+	}
+	_, _, err = ps.mergeCountries(&Country{Code: "PL", Name: "Poland"}, &Country{Code: "PL", Name: "Polska"}, 2)
+	var e *Error
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &e) || e.Table != "countries" || e.DB != 2 || e.Key != "PL" {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package shmerge
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// WriteConflictsJSON writes conflicts to w as JSON lines, one conflict per line
+// Values are not HTML escaped, so rows like <deleted> stay readable
+func WriteConflictsJSON(w io.Writer, conflicts []Conflict) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, c := range conflicts {
+		err := enc.Encode(c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteConflictsCSV writes conflicts to w as CSV with a header, one row per conflict and conflicting database
+// Columns are: table, key, db, value, chosen, rule
+func WriteConflictsCSV(w io.Writer, conflicts []Conflict) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"table", "key", "db", "value", "chosen", "rule"})
+	if err != nil {
+		return err
+	}
+	for _, c := range conflicts {
+		for _, src := range c.Sources {
+			err = cw.Write([]string{c.Table, c.Key, strconv.Itoa(src.DB), src.Value, c.Chosen, c.Rule})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeReports writes conflicts from plan to configured report writers
+func (m *Merger) writeReports(plan *Plan) error {
+	conflicts := plan.Conflicts()
+	if m.ConflictsJSON != nil {
+		err := WriteConflictsJSON(m.ConflictsJSON, conflicts)
+		if err != nil {
+			return err
+		}
+	}
+	if m.ConflictsCSV != nil {
+		err := WriteConflictsCSV(m.ConflictsCSV, conflicts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
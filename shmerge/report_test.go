@@ -0,0 +1,80 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+// testConflicts holds conflicts with values needing quoting in reports
+var testConflicts = []Conflict{
+	{
+		Table:   "profiles",
+		Key:     "u1",
+		Sources: []ConflictSource{{DB: 1, Value: `{name:A, "B", C}`}, {DB: OutputDB, Value: "line 1\nline 2"}},
+		Chosen:  `{name:A, "B", C}`,
+		Rule:    "name:prefer-first,email:prefer-non-null",
+	},
+	{
+		Table:   "countries",
+		Key:     "PL",
+		Sources: []ConflictSource{{DB: BaseDB, Value: "<deleted>"}, {DB: 2, Value: "{code:PL, name:Poland <PL> & co}"}},
+		Chosen:  "{code:PL, name:Poland <PL> & co}",
+		Rule:    "deleted",
+	},
+}
+
+func TestWriteConflictsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteConflictsJSON(&buf, testConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"table":"profiles","key":"u1","sources":[{"db":1,"value":"{name:A, \"B\", C}"},{"db":-1,"value":"line 1\nline 2"}],"chosen":"{name:A, \"B\", C}","rule":"name:prefer-first,email:prefer-non-null"}
+{"table":"countries","key":"PL","sources":[{"db":0,"value":"<deleted>"},{"db":2,"value":"{code:PL, name:Poland <PL> & co}"}],"chosen":"{code:PL, name:Poland <PL> & co}","rule":"deleted"}
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteConflictsCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteConflictsCSV(&buf, testConflicts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `table,key,db,value,chosen,rule
+profiles,u1,1,"{name:A, ""B"", C}","{name:A, ""B"", C}","name:prefer-first,email:prefer-non-null"
+profiles,u1,-1,"line 1
+line 2","{name:A, ""B"", C}","name:prefer-first,email:prefer-non-null"
+countries,PL,0,<deleted>,"{code:PL, name:Poland <PL> & co}",deleted
+countries,PL,2,"{code:PL, name:Poland <PL> & co}","{code:PL, name:Poland <PL> & co}",deleted
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteReports(t *testing.T) {
+	var jsonBuf, csvBuf bytes.Buffer
+	m := testMerger()
+	m.DryRun = true
+	m.ConflictsJSON = &jsonBuf
+	m.ConflictsCSV = &csvBuf
+	err := m.Merge(context.Background(), []*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// google.com is the only row differing between inputs
+	want := `{"table":"domains_organizations","key":"google.com","sources":[{"db":1,"value":"{id:2, domain:google.com, isTopDomain:1, orgID:2, orgName:Google, orgIDMerged:0}"},{"db":2,"value":"{id:8, domain:google.com, isTopDomain:0, orgID:5, orgName:Google, orgIDMerged:0}"}],"chosen":"{id:2, domain:google.com, isTopDomain:1, orgID:2, orgName:Google, orgIDMerged:0}","rule":"is_top_domain:prefer-first"}
+`
+	if jsonBuf.String() != want {
+		t.Fatalf("got JSON report:\n%s\nwant:\n%s", jsonBuf.String(), want)
+	}
+	if lines := strings.Split(strings.TrimSpace(csvBuf.String()), "\n"); len(lines) != 3 || !strings.HasPrefix(lines[1], "domains_organizations,google.com,1,") || !strings.HasPrefix(lines[2], "domains_organizations,google.com,2,") {
+		t.Fatalf("got CSV report:\n%s", csvBuf.String())
+	}
+}
@@ -0,0 +1,231 @@
+package shmerge
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+)
+
+// Choice tells which version of a conflicting row is used
+type Choice string
+
+// Possible choices
+const (
+	ChooseFirst  Choice = "first"  // row merged so far from higher priority inputs
+	ChooseSecond Choice = "second" // row from the lower priority input merged into it
+	ChooseMerged Choice = "merged" // row merged field by field using policies
+)
+
+// PairConflict describes two different versions of a row met when folding inputs in priority order:
+// the row merged so far from higher priority inputs and the row of the next input
+type PairConflict struct {
+	Table  string
+	Key    string
+	DB1    int    // 1-based input database number the merged row was first taken from, OutputDB for the output database when upserting
+	DB2    int    // 1-based input database number of the second version, OutputDB for the output database when upserting
+	First  string // row merged so far, as returned by String()
+	Second string // second version, as returned by String()
+	Merged string // version merged using policies, as returned by String()
+	Rule   string // policies that decided the merged version
+}
+
+// Resolver decides which version of a conflicting row is used
+type Resolver interface {
+	Resolve(c *PairConflict) (Choice, error)
+}
+
+// Decision is a recorded conflict resolution, it can be replayed in later runs
+type Decision struct {
+	Table  string `json:"table"`
+	Key    string `json:"key"`
+	First  string `json:"first"`
+	Second string `json:"second"`
+	Rule   string `json:"rule"`
+	Choice Choice `json:"choice"`
+	All    bool   `json:"all,omitempty"` // applies to all similar conflicts: the same table and the same differing fields
+}
+
+// InteractiveResolver asks the operator how to resolve every conflict and records decisions
+// Replayed decisions are applied without asking, when In is nil conflicts without decisions use policies
+type InteractiveResolver struct {
+	In     io.Reader // operator answers
+	Out    io.Writer // prompts
+	Record io.Writer // receives all decisions as JSON lines, if set
+	replay map[string]Decision
+	all    map[string]Choice
+	in     *bufio.Reader
+}
+
+// NewInteractiveResolver returns a resolver reading answers from in and writing prompts to out
+func NewInteractiveResolver(in io.Reader, out io.Writer) *InteractiveResolver {
+	return &InteractiveResolver{In: in, Out: out}
+}
+
+// decisionKey identifies a single conflict, including both row versions so changed rows are not replayed
+func decisionKey(table, key, first, second string) string {
+	return table + "\x00" + key + "\x00" + first + "\x00" + second
+}
+
+// similarKey identifies similar conflicts
+func similarKey(table, rule string) string {
+	return table + "\x00" + rule
+}
+
+// Replay reads decisions recorded in a previous run (JSON lines)
+func (r *InteractiveResolver) Replay(rd io.Reader) error {
+	if r.replay == nil {
+		r.replay = make(map[string]Decision)
+		r.all = make(map[string]Choice)
+	}
+	dec := json.NewDecoder(rd)
+	for {
+		var d Decision
+		err := dec.Decode(&d)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.Choice != ChooseFirst && d.Choice != ChooseSecond && d.Choice != ChooseMerged {
+			return fmt.Errorf("invalid choice '%s' for %s %s", d.Choice, d.Table, d.Key)
+		}
+		r.replay[decisionKey(d.Table, d.Key, d.First, d.Second)] = d
+		if d.All {
+			r.all[similarKey(d.Table, d.Rule)] = d.Choice
+		}
+	}
+}
+
+// Resolve returns a replayed or remembered choice, asks the operator otherwise
+func (r *InteractiveResolver) Resolve(c *PairConflict) (Choice, error) {
+	if r.all == nil {
+		r.all = make(map[string]Choice)
+	}
+	d, ok := r.replay[decisionKey(c.Table, c.Key, c.First, c.Second)]
+	if !ok {
+		d = Decision{Table: c.Table, Key: c.Key, First: c.First, Second: c.Second, Rule: c.Rule}
+		choice, ok := r.all[similarKey(c.Table, c.Rule)]
+		switch {
+		case ok:
+			d.Choice = choice
+		case r.In == nil:
+			d.Choice = ChooseMerged
+		default:
+			var err error
+			d.Choice, d.All, err = r.ask(c)
+			if err != nil {
+				return "", err
+			}
+			if d.All {
+				r.all[similarKey(c.Table, c.Rule)] = d.Choice
+			}
+		}
+	}
+	if r.Record != nil {
+		enc := json.NewEncoder(r.Record)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(d)
+		if err != nil {
+			return "", err
+		}
+	}
+	return d.Choice, nil
+}
+
+// ask shows both versions side by side and reads the operator choice
+func (r *InteractiveResolver) ask(c *PairConflict) (Choice, bool, error) {
+	if r.in == nil {
+		r.in = bufio.NewReader(r.In)
+	}
+	w := r.Out
+	if w == nil {
+		w = ioutil.Discard
+	}
+	fmt.Fprintf(w, "\nConflict: %s %s (%s)\n", c.Table, c.Key, c.Rule)
+	err := sideBySide(w, []string{"1: merged so far", "2: " + dbName(c.DB2), "m: policies"}, []string{c.First, c.Second, c.Merged})
+	if err != nil {
+		return "", false, err
+	}
+	for {
+		fmt.Fprintf(w, "Use 1 (merged so far), 2 (%s) or m (merged using policies, default), append ! to apply to all similar %s conflicts, q quits: ", srcName(c.DB2), c.Table)
+		line, err := r.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", false, fmt.Errorf("reading answer for %s %s: %w", c.Table, c.Key, err)
+		}
+		answer := strings.TrimSpace(line)
+		all := strings.HasSuffix(answer, "!")
+		switch strings.TrimSuffix(answer, "!") {
+		case "1":
+			return ChooseFirst, all, nil
+		case "2":
+			return ChooseSecond, all, nil
+		case "m", "":
+			return ChooseMerged, all, nil
+		case "q":
+			return "", false, ErrAborted
+		}
+		fmt.Fprintf(w, "Invalid answer '%s'\n", answer)
+	}
+}
+
+// fields splits a row returned by String() into field names and values
+func fields(row string) ([]string, []string) {
+	var names, values []string
+	for _, field := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(row, "{"), "}"), ", ") {
+		ary := strings.SplitN(field, ":", 2)
+		if len(ary) < 2 {
+			ary = append([]string{""}, ary...)
+		}
+		names = append(names, ary[0])
+		values = append(values, strings.TrimSpace(ary[1]))
+	}
+	return names, values
+}
+
+// sideBySide writes rows as columns, one line per field, fields that differ are marked with *
+func sideBySide(w io.Writer, labels, rows []string) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  field\t%s\n", strings.Join(labels, "\t"))
+	names, _ := fields(rows[0])
+	columns := make([][]string, len(rows))
+	for i, row := range rows {
+		_, columns[i] = fields(row)
+	}
+	for f, name := range names {
+		mark := " "
+		var values []string
+		for i := range columns {
+			v := ""
+			if f < len(columns[i]) {
+				v = columns[i][f]
+			}
+			if i > 0 && v != values[0] {
+				mark = "*"
+			}
+			values = append(values, v)
+		}
+		fmt.Fprintf(tw, "%s %s\t%s\n", mark, name, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+// resolve lets r choose between the first, the second and the merged version of a row
+// It returns the choice and the rule that decided it
+func resolve(r Resolver, c *PairConflict) (Choice, string, error) {
+	if r == nil {
+		return ChooseMerged, c.Rule, nil
+	}
+	choice, err := r.Resolve(c)
+	if err != nil {
+		return "", "", wrapError(err, c.Table, c.DB2, "resolve", c.Key)
+	}
+	if choice == ChooseMerged {
+		return choice, c.Rule, nil
+	}
+	return choice, "resolver:" + string(choice), nil
+}
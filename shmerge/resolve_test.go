@@ -0,0 +1,153 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPairConflicts holds two similar profiles conflicts and a countries one
+var testPairConflicts = []PairConflict{
+	{Table: "profiles", Key: "u1", DB1: 1, DB2: 2, First: "{uuid:u1, email:a@x.com}", Second: "{uuid:u1, email:a@y.com}", Merged: "{uuid:u1, email:a@x.com}", Rule: "email:prefer-non-null"},
+	{Table: "profiles", Key: "u2", DB1: 1, DB2: 2, First: "{uuid:u2, email:b@x.com}", Second: "{uuid:u2, email:b@y.com}", Merged: "{uuid:u2, email:b@x.com}", Rule: "email:prefer-non-null"},
+	{Table: "countries", Key: "PL", DB1: 1, DB2: OutputDB, First: "{code:PL, name:Poland}", Second: "{code:PL, name:Polska}", Merged: "{code:PL, name:Poland}", Rule: "name:prefer-first"},
+}
+
+func TestInteractiveResolver(t *testing.T) {
+	var out, record bytes.Buffer
+	r := NewInteractiveResolver(strings.NewReader("x\n2!\n1\n"), &out)
+	r.Record = &record
+	var choices []Choice
+	for i := range testPairConflicts {
+		choice, err := r.Resolve(&testPairConflicts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		choices = append(choices, choice)
+	}
+	// the second profiles conflict is similar to the first one, so it is not asked for
+	want := []Choice{ChooseSecond, ChooseSecond, ChooseFirst}
+	if !reflect.DeepEqual(choices, want) {
+		t.Fatalf("got choices %v, want %v", choices, want)
+	}
+	prompts := out.String()
+	if n := strings.Count(prompts, "\nConflict: "); n != 2 {
+		t.Fatalf("got %d prompts:\n%s", n, prompts)
+	}
+	for _, s := range []string{
+		"Invalid answer 'x'",
+		"  field  1: merged so far  2: 2nd input database  m: policies\n",
+		"* email  a@x.com           a@y.com                a@x.com\n",
+		"Use 1 (merged so far), 2 (output) or m (merged using policies, default)",
+	} {
+		if !strings.Contains(prompts, s) {
+			t.Fatalf("prompts miss %q:\n%s", s, prompts)
+		}
+	}
+
+	// replayed decisions are used without asking, conflicts with changed rows are not replayed
+	replay := NewInteractiveResolver(nil, nil)
+	err := replay.Replay(bytes.NewReader(record.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range testPairConflicts {
+		choice, err := replay.Resolve(&testPairConflicts[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if choice != want[i] {
+			t.Fatalf("replayed %s %s as %s, want %s", testPairConflicts[i].Table, testPairConflicts[i].Key, choice, want[i])
+		}
+	}
+	changed := testPairConflicts[2]
+	changed.Second = "{code:PL, name:Polen}"
+	choice, err := replay.Resolve(&changed)
+	if err != nil || choice != ChooseMerged {
+		t.Fatalf("changed conflict resolved as %s, %v, want %s", choice, err, ChooseMerged)
+	}
+	// all similar decisions are replayed too
+	similar := testPairConflicts[0]
+	similar.Key, similar.Second = "u3", "{uuid:u3, email:c@y.com}"
+	choice, err = replay.Resolve(&similar)
+	if err != nil || choice != ChooseSecond {
+		t.Fatalf("similar conflict resolved as %s, %v, want %s", choice, err, ChooseSecond)
+	}
+}
+
+func TestInteractiveResolverErrors(t *testing.T) {
+	_, err := NewInteractiveResolver(strings.NewReader("q\n"), nil).Resolve(&testPairConflicts[0])
+	if !errors.Is(err, ErrAborted) {
+		t.Fatalf("got %v, want %v", err, ErrAborted)
+	}
+	_, err = NewInteractiveResolver(strings.NewReader(""), nil).Resolve(&testPairConflicts[0])
+	if err == nil {
+		t.Fatal("no error when answers end")
+	}
+	err = NewInteractiveResolver(nil, nil).Replay(strings.NewReader(`{"table":"countries","key":"PL","choice":"third"}`))
+	if err == nil || err.Error() != "invalid choice 'third' for countries PL" {
+		t.Fatalf("got %v", err)
+	}
+}
+
+// testConflicting differs from testBase in many rows of the same tables
+const testConflicting = `
+INSERT INTO countries VALUES ('PL','Polska','POL'),('DE','Germany','DEU'),('FR','France','FRA');
+INSERT INTO organizations VALUES (1,'CNCF'),(2,'Google');
+INSERT INTO uidentities VALUES ('u1','2020-01-01 00:00:00.000000'),('u2','2020-01-01 00:00:00.000000');
+INSERT INTO profiles VALUES ('u1','User 1','one@y.com',NULL,NULL,0,'PL'),('u2','User 2','two@y.com',NULL,NULL,0,NULL);
+INSERT INTO identities VALUES ('i1','User 1',NULL,'u1','github','u1','2020-01-01 00:00:00.000000'),('i2','User 2','two@y.com','u2','git','u2','2020-01-01 00:00:00.000000');
+INSERT INTO enrollments VALUES (1,'1900-01-01 00:00:00','2100-01-01 00:00:00','u1',2),(2,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',1);
+`
+
+// TestInteractiveMerge checks conflicts are asked for in the same order in every run and replaying recorded decisions
+// gives the same merged database
+func TestInteractiveMerge(t *testing.T) {
+	dir := t.TempDir()
+	inputs := []*sql.DB{openTestDump(t, testBase), openTestDump(t, testConflicting)}
+	merge := func(name string, r *InteractiveResolver) []byte {
+		m := testMerger()
+		m.Resolver = r
+		path := filepath.Join(dir, name)
+		err := m.Merge(context.Background(), inputs, CreateDump(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	var prompts, records []string
+	var merged []byte
+	for run := 0; run < 2; run++ {
+		var out, record bytes.Buffer
+		// alternate answers, so the merged database depends on the order of prompts
+		r := NewInteractiveResolver(strings.NewReader(strings.Repeat("2\n1\n", 20)), &out)
+		r.Record = &record
+		merged = merge("interactive.sql", r)
+		prompts = append(prompts, out.String())
+		records = append(records, record.String())
+	}
+	if n := strings.Count(prompts[0], "\nConflict: "); n != 7 {
+		t.Fatalf("got %d conflicts, want more:\n%s", n, prompts[0])
+	}
+	if prompts[0] != prompts[1] || records[0] != records[1] {
+		t.Fatalf("conflicts asked for in different orders:\n%s\n\n%s", prompts[0], prompts[1])
+	}
+	replay := NewInteractiveResolver(nil, nil)
+	err := replay.Replay(strings.NewReader(records[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed := merge("replayed.sql", replay); !bytes.Equal(replayed, merged) {
+		t.Fatal("replaying decisions gave another merged database")
+	}
+}
@@ -0,0 +1,33 @@
+//go:build cgo
+// +build cgo
+
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestFailedWriteKeepsOutput(t *testing.T) {
+	ctx := context.Background()
+	out := openTestSQLite(t, "")
+	err := testMerger().Merge(ctx, []*sql.DB{openTestDump(t, testBase)}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := loadTest(t, out)[0].checksum()
+	// tables before identities are already deleted and written again when the insert fails
+	_, err = out.Exec("create trigger fail_identities before insert on identities begin select raise(abort, 'injected failure'); end")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = testMerger().Merge(ctx, []*sql.DB{openTestDump(t, testBase), openTestDump(t, testCased)}, out)
+	if err == nil || !strings.Contains(err.Error(), "injected failure") {
+		t.Fatalf("got error %v, want the injected failure", err)
+	}
+	if after := loadTest(t, out)[0].checksum(); after != before {
+		t.Fatal("failed merge changed the output database")
+	}
+}
@@ -0,0 +1,118 @@
+package shmerge
+
+// schema creates all Sorting Hat tables, just like dump_struct.sql
+const schema = `CREATE TABLE countries (
+  code varchar(2) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  name varchar(191) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  alpha3 varchar(3) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  PRIMARY KEY (code),
+  UNIQUE KEY _alpha_unique (alpha3)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE domains_organizations (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  domain varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  is_top_domain tinyint(1) DEFAULT NULL,
+  organization_id int(11) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY _domain_unique (domain),
+  KEY organization_id (organization_id),
+  CONSTRAINT domains_organizations_ibfk_1 FOREIGN KEY (organization_id) REFERENCES organizations (id) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE enrollments (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  start datetime NOT NULL,
+  end datetime NOT NULL,
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  organization_id int(11) NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY _period_unique (uuid,organization_id,start,end),
+  KEY organization_id (organization_id),
+  CONSTRAINT enrollments_ibfk_1 FOREIGN KEY (uuid) REFERENCES uidentities (uuid) ON DELETE CASCADE,
+  CONSTRAINT enrollments_ibfk_2 FOREIGN KEY (organization_id) REFERENCES organizations (id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE enrollments_archive (
+  archived_at datetime(6) NOT NULL DEFAULT current_timestamp(6),
+  id int(11) NOT NULL,
+  start datetime NOT NULL,
+  end datetime NOT NULL,
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  organization_id int(11) NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE identities (
+  id varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  name varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  email varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  username varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  source varchar(32) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  last_modified datetime(6) DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY _identity_unique (name,email,username,source),
+  KEY uuid (uuid),
+  CONSTRAINT identities_ibfk_1 FOREIGN KEY (uuid) REFERENCES uidentities (uuid) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE identities_archive (
+  archived_at datetime(6) NOT NULL DEFAULT current_timestamp(6),
+  id varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  name varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  email varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  username varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  source varchar(32) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  last_modified datetime(6) DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE matching_blacklist (
+  excluded varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  PRIMARY KEY (excluded)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE organizations (
+  id int(11) NOT NULL AUTO_INCREMENT,
+  name varchar(191) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY _name_unique (name)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE profiles (
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  name varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  email varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  gender varchar(32) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  gender_acc int(11) DEFAULT NULL,
+  is_bot tinyint(1) DEFAULT NULL,
+  country_code varchar(2) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  PRIMARY KEY (uuid),
+  KEY country_code (country_code),
+  CONSTRAINT profiles_ibfk_1 FOREIGN KEY (uuid) REFERENCES uidentities (uuid) ON DELETE CASCADE,
+  CONSTRAINT profiles_ibfk_2 FOREIGN KEY (country_code) REFERENCES countries (code) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE profiles_archive (
+  archived_at datetime(6) NOT NULL DEFAULT current_timestamp(6),
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  name varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  email varchar(128) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  gender varchar(32) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL,
+  gender_acc int(11) DEFAULT NULL,
+  is_bot tinyint(1) DEFAULT NULL,
+  country_code varchar(2) COLLATE utf8mb4_unicode_520_ci DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE uidentities (
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  last_modified datetime(6) DEFAULT NULL,
+  PRIMARY KEY (uuid)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+
+CREATE TABLE uidentities_archive (
+  archived_at datetime(6) NOT NULL DEFAULT current_timestamp(6),
+  uuid varchar(128) COLLATE utf8mb4_unicode_520_ci NOT NULL,
+  last_modified datetime(6) DEFAULT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_520_ci;
+`
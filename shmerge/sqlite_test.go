@@ -0,0 +1,234 @@
+//go:build cgo
+// +build cgo
+
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestSQLite returns a writable SQLite database holding all Sorting Hat tables and rows inserted by data
+func openTestSQLite(t *testing.T, data string) *sql.DB {
+	t.Helper()
+	db, err := SQLite.Open(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, stmt := range strings.Split(data, ";\n") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	return db
+}
+
+func TestBeforeCommit(t *testing.T) {
+	d := &Dialect{
+		Name:         "sqlite3-hook",
+		Driver:       "sqlite3",
+		Rewrite:      rewriteSQLite,
+		CreateSchema: true,
+		BeforeCommit: []string{"insert into hook(n) select count(*) from organizations"},
+	}
+	db, err := d.Open(context.Background(), filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec("create table hook(n int)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("insert into organizations(id, name) values(?, ?)", 5, "CNCF")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// read-only transactions do not run the hook
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = tx.QueryRow("select count(*) from organizations").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hooks []int
+	rows, err := db.Query("select n from hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hooks = append(hooks, n)
+	}
+	if rows.Err() != nil {
+		t.Fatal(rows.Err())
+	}
+	if len(hooks) != 1 || hooks[0] != 1 {
+		t.Fatalf("hook ran with organizations counts %v, want [1]", hooks)
+	}
+}
+
+func TestInsertPlaceholdersLimit(t *testing.T) {
+	ctx := context.Background()
+	// rows of every insert statement, counted by the dialect
+	var inserts []int
+	d := &Dialect{
+		Name:   "sqlite3-count",
+		Driver: "sqlite3",
+		Rewrite: func(query string) string {
+			if strings.HasPrefix(query, "insert into organizations") {
+				inserts = append(inserts, strings.Count(query, "(?"))
+			}
+			return rewriteSQLite(query)
+		},
+		CreateSchema:    true,
+		MaxPlaceholders: 10,
+	}
+	insertOrgs := func(db *sql.DB, batchSize, n int) {
+		t.Helper()
+		m := testMerger()
+		m.BatchSize = batchSize
+		err := m.writeDatabase(ctx, db, func(ctx context.Context, tx *sql.Tx) error {
+			ins := m.newInserter(ctx, tx, "organizations", "id", "name")
+			for i := 1; i <= n; i++ {
+				err := ins.add(strconv.Itoa(i), i, "org "+strconv.Itoa(i))
+				if err != nil {
+					return err
+				}
+			}
+			return ins.flush()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var count int
+		err = db.QueryRow("select count(*) from organizations").Scan(&count)
+		if err != nil || count != n {
+			t.Fatalf("got %d organizations, %v, want %d", count, err, n)
+		}
+	}
+
+	db, err := d.Open(ctx, filepath.Join(t.TempDir(), "count.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	insertOrgs(db, 1000, 12)
+	if want := []int{5, 5, 2}; !reflect.DeepEqual(inserts, want) {
+		t.Fatalf("got statements inserting %v rows, want %v", inserts, want)
+	}
+
+	// statements using more placeholders than SQLite allows fail, so the batch must be split at its limit
+	if n := maxPlaceholders(openTestSQLite(t, "")); n != 32766 {
+		t.Fatalf("got SQLite placeholders limit %d, want 32766", n)
+	}
+	insertOrgs(openTestSQLite(t, ""), 20000, 20000)
+}
+
+func TestSQLiteSchema(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "schema.db")
+	db, err := SQLite.Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tables := make(map[string]bool)
+	err = queryRows(ctx, db, "sqlite_master", OutputDB, "select name from sqlite_master where type = 'table'", func(rows *sql.Rows) error {
+		var name string
+		err := rows.Scan(&name)
+		tables[name] = true
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range schemaTables() {
+		if !tables[name] {
+			t.Errorf("table %s not created", name)
+		}
+	}
+	if len(tables) != len(schemaTables()) {
+		t.Errorf("got tables %v, want Sorting Hat tables only", tables)
+	}
+	// opening a database holding rows again keeps them
+	_, err = db.Exec("insert into organizations(id, name) values(?, ?), (?, ?)", 1, "CNCF", 2, "Google")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := SQLite.Open(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if orgs := loadTest(t, again)[0].orgs; len(orgs) != 2 {
+		t.Fatalf("got organizations %v after opening again, want 2", orgs)
+	}
+}
+
+// TestSQLiteMerge checks merging into SQLite and reading SQLite inputs give the same database as dump files
+func TestSQLiteMerge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	merged := func(inputs []*sql.DB, name string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		err := testMerger().Merge(ctx, inputs, CreateDump(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := OpenDump(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loadTest(t, db)[0].checksum()
+	}
+	want := merged([]*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}, "dumps.sql")
+
+	out := openTestSQLite(t, "")
+	err := testMerger().Merge(ctx, []*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := loadTest(t, out)[0]
+	if s.checksum() != want {
+		t.Fatal("database merged into SQLite differs from the one merged into a dump file")
+	}
+	if len(s.enrollments) != 2 || len(s.identities) != 2 {
+		t.Fatalf("got %d enrollments and %d identities, want 2 of each", len(s.enrollments), len(s.identities))
+	}
+	if got := merged([]*sql.DB{openTestSQLite(t, testBase), openTestSQLite(t, testChanged)}, "sqlite.sql"); got != want {
+		t.Fatal("database merged from SQLite inputs differs from the one merged from dump files")
+	}
+}
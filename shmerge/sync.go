@@ -0,0 +1,197 @@
+package shmerge
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// keyColumns are key columns of tables with last_modified, their deleted rows are detected using keys checksums
+var keyColumns = [][2]string{{"uidentities", "uuid"}, {"identities", "id"}}
+
+// SyncStatus describes the state of a continuous sync
+type SyncStatus struct {
+	Running     bool      `json:"running"`
+	Syncs       int       `json:"syncs"`           // number of finished syncs, including failed ones
+	LastSync    time.Time `json:"last_sync"`       // start of the last finished sync
+	LastSuccess time.Time `json:"last_success"`    // start of the last successful sync
+	Duration    string    `json:"duration"`        // duration of the last finished sync
+	Full        bool      `json:"full"`            // last sync did a full merge, because tables without last_modified changed
+	Checksums   []string  `json:"checksums"`       // checksums of inputs used to detect such changes, in inputs order
+	Error       string    `json:"error,omitempty"` // error of the last sync, if it failed
+	NextSync    time.Time `json:"next_sync"`       // when the next sync starts
+}
+
+// Syncer keeps the output database in sync with inputs, merging them every Interval
+// Changes of uidentities are detected using last_modified and merged incrementally,
+// changes of other tables and deleted rows are detected using checksums and cause a full merge
+// Merges are upserts, so the output database is never wiped
+type Syncer struct {
+	// Merger merges inputs in every sync, it must have Incremental and Upsert set
+	Merger   *Merger
+	Interval time.Duration
+	mu       sync.Mutex
+	status   SyncStatus
+}
+
+// NewSyncer returns a syncer merging every interval using a copy of m with Incremental and Upsert set, m is not changed
+func NewSyncer(m *Merger, interval time.Duration) *Syncer {
+	sm := *m
+	sm.Incremental = true
+	sm.Upsert = true
+	return &Syncer{Merger: &sm, Interval: interval}
+}
+
+// Status returns the current sync status
+func (s *Syncer) Status() SyncStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Checksums = append([]string{}, s.status.Checksums...)
+	return status
+}
+
+// ServeHTTP writes the current sync status as JSON
+func (s *Syncer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(s.Status())
+}
+
+// Run syncs inputs into the output database every s.Interval until ctx is done
+// Failed syncs are reported in the status and retried in the next interval
+func (s *Syncer) Run(ctx context.Context, inputs []*sql.DB, output *sql.DB) error {
+	m := s.Merger
+	if m.DryRun || m.Base != nil || m.ExportConflicts != nil || m.ApplyConflicts != nil {
+		return fmt.Errorf("sync cannot be a dry run, a three-way merge or use conflicts files")
+	}
+	if s.Interval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %v", s.Interval)
+	}
+	s.mu.Lock()
+	s.status.Running = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.status.Running = false
+		s.status.NextSync = time.Time{}
+		s.mu.Unlock()
+	}()
+	for {
+		s.sync(ctx, inputs, output)
+		next := time.Now().Add(s.Interval)
+		s.mu.Lock()
+		s.status.NextSync = next
+		s.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// sync runs a single sync, a full merge when checksums of tables without last_modified changed, an incremental one otherwise
+func (s *Syncer) sync(ctx context.Context, inputs []*sql.DB, output *sql.DB) {
+	m := s.Merger
+	start := time.Now()
+	prev := s.Status().Checksums
+	checksums, err := m.syncChecksums(ctx, inputs)
+	// full is only reported when the merge was attempted, not when checksums could not be computed
+	full := false
+	if err == nil {
+		full = len(prev) != len(checksums)
+		for i := 0; !full && i < len(checksums); i++ {
+			full = prev[i] != checksums[i]
+		}
+		if full {
+			m.printf("tables without last_modified changed, doing a full merge\n")
+		}
+		err = m.mergeInto(ctx, inputs, output, !full)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.Syncs++
+	s.status.LastSync = start
+	s.status.Duration = time.Since(start).String()
+	s.status.Full = full
+	s.status.Error = ""
+	if err != nil {
+		m.printf("sync failed: %v\n", err)
+		s.status.Error = err.Error()
+		return
+	}
+	s.status.LastSuccess = start
+	s.status.Checksums = checksums
+}
+
+// syncChecksums returns, for every input, a checksum of tables without last_modified,
+// keys of tables with last_modified (to detect deleted rows) and numbers of archived rows
+func (m *Merger) syncChecksums(ctx context.Context, inputs []*sql.DB) ([]string, error) {
+	var dbNums []int
+	for i := range inputs {
+		dbNums = append(dbNums, i+1)
+	}
+	extra := make([][]string, len(inputs))
+	snaps, err := m.loadDatabases(ctx, inputs, dbNums, func(g *group, db *sql.DB, dbNum int, s *snapshot) {
+		loadReferenceTables(g, db, dbNum, s)
+		loadLookupTables(g, db, dbNum, s)
+		sums := make([]string, len(keyColumns)+len(archiveTables))
+		extra[dbNum-1] = sums
+		for i, kc := range keyColumns {
+			i, table, column := i, kc[0], kc[1]
+			g.do(func(ctx context.Context) error {
+				var keys []string
+				key := ""
+				err := queryRows(ctx, db, table, dbNum, "select "+column+" from "+table, func(rows *sql.Rows) error {
+					err := rows.Scan(&key)
+					if err != nil {
+						return err
+					}
+					keys = append(keys, key)
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				sort.Strings(keys)
+				h := sha256.New()
+				for _, key := range keys {
+					h.Write([]byte(key + "\n"))
+				}
+				sums[i] = table + " " + hex.EncodeToString(h.Sum(nil))
+				return nil
+			})
+		}
+		for i, table := range archiveTables {
+			i, table := len(keyColumns)+i, table
+			g.do(func(ctx context.Context) error {
+				n := 0
+				err := db.QueryRowContext(ctx, "select count(*) from "+table).Scan(&n)
+				sums[i] = fmt.Sprintf("%s %d", table, n)
+				return wrapError(err, table, dbNum, "count", "")
+			})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	var checksums []string
+	for i, snap := range snaps {
+		h := sha256.New()
+		h.Write([]byte(snap.checksum()))
+		for _, sum := range extra[i] {
+			h.Write([]byte("\n" + sum))
+		}
+		checksums = append(checksums, hex.EncodeToString(h.Sum(nil)))
+	}
+	return checksums, nil
+}
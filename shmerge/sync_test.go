@@ -0,0 +1,176 @@
+//go:build cgo
+// +build cgo
+
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewSyncerCopiesMerger(t *testing.T) {
+	m := testMerger()
+	m.BatchSize = 10
+	s := NewSyncer(m, time.Minute)
+	if m.Incremental || m.Upsert {
+		t.Fatal("NewSyncer changed the merger")
+	}
+	if s.Merger == m || !s.Merger.Incremental || !s.Merger.Upsert || s.Merger.BatchSize != 10 {
+		t.Fatalf("got syncer merger %+v, want an incremental upserting copy", s.Merger)
+	}
+}
+
+func TestSyncerSync(t *testing.T) {
+	ctx := context.Background()
+	inputs := []*sql.DB{openTestSQLite(t, testBase), openTestSQLite(t, testChanged)}
+	out := openTestSQLite(t, "")
+	m := testMerger()
+	m.InputIDs = []string{"base", "changed"}
+	s := NewSyncer(m, time.Minute)
+	check := func(syncs int, full bool, errMsg string) SyncStatus {
+		t.Helper()
+		status := s.Status()
+		if status.Syncs != syncs || status.Full != full || status.Error != errMsg {
+			t.Fatalf("got %d syncs, full %v, error %q, want %d, %v, %q", status.Syncs, status.Full, status.Error, syncs, full, errMsg)
+		}
+		return status
+	}
+
+	// the first sync is a full merge
+	s.sync(ctx, inputs, out)
+	first := check(1, true, "")
+	if len(first.Checksums) != 2 || !first.LastSuccess.Equal(first.LastSync) {
+		t.Fatalf("got status %+v after a successful sync", first)
+	}
+	if orgs := loadTest(t, out)[0].orgs; len(orgs) != 2 {
+		t.Fatalf("got organizations %v in output, want CNCF and Google", orgs)
+	}
+
+	// nothing changed, only uidentities modified since the previous sync are merged
+	s.sync(ctx, inputs, out)
+	check(2, false, "")
+
+	// a new organization changes the checksum of its input
+	_, err := inputs[1].Exec("insert into organizations(id, name) values(7, 'Linux Foundation')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sync(ctx, inputs, out)
+	synced := check(3, true, "")
+	if synced.Checksums[0] != first.Checksums[0] || synced.Checksums[1] == first.Checksums[1] {
+		t.Fatal("checksum of the changed input only should change")
+	}
+	if orgs := loadTest(t, out)[0].orgs; len(orgs) != 3 {
+		t.Fatalf("got organizations %v in output, want the added one too", orgs)
+	}
+
+	// a failure reading checksums doesn't merge, so the sync is not reported as full
+	_, err = inputs[1].Exec("drop table matching_blacklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.sync(ctx, inputs, out)
+	failed := check(4, false, "matching_blacklist: query (2nd input database): no such table: matching_blacklist")
+	if !failed.LastSuccess.Equal(synced.LastSync) || failed.LastSync.Equal(synced.LastSync) {
+		t.Fatalf("got last sync %v and success %v, want the failed and the previous sync", failed.LastSync, failed.LastSuccess)
+	}
+	if failed.Checksums[1] != synced.Checksums[1] {
+		t.Fatal("failed sync replaced checksums")
+	}
+}
+
+func TestSyncerRun(t *testing.T) {
+	inputs := []*sql.DB{openTestDump(t, testBase)}
+	out := openTestSQLite(t, "")
+	m := testMerger()
+	m.InputIDs = []string{"base"}
+	s := NewSyncer(m, time.Hour)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	get := func() SyncStatus {
+		t.Helper()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); resp.StatusCode != http.StatusOK || ct != "application/json" {
+			t.Fatalf("got status %d and content type %s", resp.StatusCode, ct)
+		}
+		var status SyncStatus
+		err = json.NewDecoder(resp.Body).Decode(&status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	if status := get(); status.Running || status.Syncs != 0 {
+		t.Fatalf("got status %+v before running", status)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx, inputs, out) }()
+	deadline := time.Now().Add(10 * time.Second)
+	// the next sync is set after the first one finished, it is an hour later, so there is a single sync
+	for s.Status().NextSync.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("first sync did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := get()
+	if !status.Running || status.Syncs != 1 || !status.Full || status.Error != "" || len(status.Checksums) != 1 {
+		t.Fatalf("got status %+v while running", status)
+	}
+	if next := status.NextSync.Sub(status.LastSync); next < time.Hour || next > time.Hour+10*time.Second {
+		t.Fatalf("next sync %v after the last one, want an hour", next)
+	}
+	if !status.LastSuccess.Equal(s.Status().LastSuccess) {
+		t.Fatalf("served last success %v, status has %v", status.LastSuccess, s.Status().LastSuccess)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	if status := get(); status.Running || !status.NextSync.IsZero() || status.Syncs != 1 {
+		t.Fatalf("got status %+v after Run returned", status)
+	}
+}
+
+func TestSyncerRunErrors(t *testing.T) {
+	dryRun := testMerger()
+	dryRun.DryRun = true
+	tests := []struct {
+		name     string
+		merger   *Merger
+		interval time.Duration
+		err      string
+	}{
+		{"dry run", dryRun, time.Minute, "sync cannot be a dry run, a three-way merge or use conflicts files"},
+		{"interval", testMerger(), 0, "sync interval must be positive, got 0s"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSyncer(test.merger, test.interval)
+			err := s.Run(context.Background(), nil, nil)
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("got error %v, want %s", err, test.err)
+			}
+			if s.Status().Running || s.Status().Syncs != 0 {
+				t.Fatal("failed Run changed the status")
+			}
+		})
+	}
+}
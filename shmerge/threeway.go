@@ -0,0 +1,352 @@
+package shmerge
+
+import (
+	"strings"
+	"time"
+)
+
+// threeWayKey classifies a single row key against the base database
+// inBase reports if the base has the row, has(i) reports if i-th input has it
+// and differs(i) reports if i-th input version differs from the base one (called only when both have it)
+// It returns inputs still holding the base version of a row changed elsewhere (they must not take part in merging it)
+// and whether the row was deleted in some inputs while being modified or added in others
+func threeWayKey(n int, inBase bool, has, differs func(i int) bool) (stale []int, conflict bool) {
+	changed := make([]bool, n)
+	anyChanged, deleted, modified := false, false, false
+	for i := 0; i < n; i++ {
+		h := has(i)
+		changed[i] = h != inBase || (h && differs(i))
+		if !changed[i] {
+			continue
+		}
+		anyChanged = true
+		if h {
+			modified = true
+		} else {
+			deleted = true
+		}
+	}
+	if !anyChanged {
+		return nil, false
+	}
+	for i := 0; i < n; i++ {
+		if !changed[i] && has(i) {
+			stale = append(stale, i)
+		}
+	}
+	return stale, deleted && modified
+}
+
+func strPtrsDiffer(s1, s2 *string) bool {
+	return s1 == nil && s2 != nil || s1 != nil && s2 == nil || s1 != nil && s2 != nil && *s1 != *s2
+}
+
+func timePtrsDiffer(t1, t2 *time.Time) bool {
+	return t1 == nil && t2 != nil || t1 != nil && t2 == nil || t1 != nil && t2 != nil && !t1.Equal(*t2)
+}
+
+// threeWay returns copies of inputs without rows that were not changed in a given input compared to the base, but were changed in some other input
+// This way changes made only in one input win, deletions propagate and only rows changed in many inputs are merged using priorities
+// Rows deleted in some inputs but modified in others are recorded as conflicts in plan
+// inputs are not modified, they are still used to allocate and map IDs and to write back
+func (m *Merger) threeWay(base *snapshot, inputs []*snapshot, order []int, plan *Plan) []*snapshot {
+	n := len(inputs)
+	srcs := make([]*snapshot, n)
+	for i, s := range inputs {
+		srcs[i] = s.clone()
+	}
+	// value returns i-th input version of a row and reports if it has the row
+	conflict := func(table, key string, value func(i int) (string, bool), baseValue string) {
+		m.printf("Conflict: %s %s deleted in some inputs and modified in others, keeping modified\n", table, key)
+		c := Conflict{Table: table, Key: key, Rule: RuleKeepModified, Sources: []ConflictSource{{DB: BaseDB, Value: baseValue}}}
+		for _, i := range order {
+			v, ok := value(i)
+			if !ok {
+				v = deletedStr
+			} else if c.Chosen == "" {
+				c.Chosen = v
+			}
+			c.Sources = append(c.Sources, ConflictSource{DB: i + 1, Value: v})
+		}
+		tp := plan.table(table)
+		tp.Conflicts = append(tp.Conflicts, c)
+	}
+	m.printf("three-way countries...\n")
+	cKeys := make(map[string]struct{})
+	for code := range base.countries {
+		cKeys[code] = struct{}{}
+	}
+	for _, s := range srcs {
+		for code := range s.countries {
+			cKeys[code] = struct{}{}
+		}
+	}
+	for code := range cKeys {
+		bc, inBase := base.countries[code]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].countries[code]; return ok },
+			func(i int) bool { c := srcs[i].countries[code]; return c.Name != bc.Name || c.Alpha3 != bc.Alpha3 },
+		)
+		for _, i := range stale {
+			delete(srcs[i].countries, code)
+		}
+		if conf {
+			conflict("countries", code, func(i int) (string, bool) { c, ok := srcs[i].countries[code]; return c.String(), ok }, bc.String())
+		}
+	}
+	m.printf("three-way organizations...\n")
+	oKeys := make(map[string]struct{})
+	for lName := range base.orgNames {
+		oKeys[lName] = struct{}{}
+	}
+	for _, s := range srcs {
+		for lName := range s.orgNames {
+			oKeys[lName] = struct{}{}
+		}
+	}
+	for lName := range oKeys {
+		bName, inBase := base.orgNames[lName]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].orgNames[lName]; return ok },
+			func(i int) bool { return srcs[i].orgNames[lName] != bName },
+		)
+		for _, i := range stale {
+			delete(srcs[i].orgNames, lName)
+		}
+		if conf {
+			conflict("organizations", lName, func(i int) (string, bool) { name, ok := srcs[i].orgNames[lName]; return name, ok }, bName)
+		}
+	}
+	m.printf("three-way domains_organizations...\n")
+	dKeys := make(map[string]struct{})
+	for lDomain := range base.domains {
+		dKeys[lDomain] = struct{}{}
+	}
+	for _, s := range srcs {
+		for lDomain := range s.domains {
+			dKeys[lDomain] = struct{}{}
+		}
+	}
+	for lDomain := range dKeys {
+		bd, inBase := base.domains[lDomain]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].domains[lDomain]; return ok },
+			func(i int) bool {
+				do := srcs[i].domains[lDomain]
+				return do.Domain != bd.Domain || do.IsTopDomain != bd.IsTopDomain || !strings.EqualFold(do.OrgName, bd.OrgName)
+			},
+		)
+		for _, i := range stale {
+			delete(srcs[i].domains, lDomain)
+		}
+		if conf {
+			conflict("domains_organizations", lDomain, func(i int) (string, bool) { do, ok := srcs[i].domains[lDomain]; return do.String(), ok }, bd.String())
+		}
+	}
+	m.printf("three-way matching_blacklist...\n")
+	bKeys := make(map[string]struct{})
+	for lBl := range base.blacklist {
+		bKeys[lBl] = struct{}{}
+	}
+	for _, s := range srcs {
+		for lBl := range s.blacklist {
+			bKeys[lBl] = struct{}{}
+		}
+	}
+	for lBl := range bKeys {
+		_, inBase := base.blacklist[lBl]
+		stale, _ := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].blacklist[lBl]; return ok },
+			func(i int) bool { return false },
+		)
+		for _, i := range stale {
+			delete(srcs[i].blacklist, lBl)
+		}
+	}
+	m.printf("three-way uidentities...\n")
+	uKeys := make(map[string]struct{})
+	for uuid := range base.uidentities {
+		uKeys[uuid] = struct{}{}
+	}
+	for _, s := range srcs {
+		for uuid := range s.uidentities {
+			uKeys[uuid] = struct{}{}
+		}
+	}
+	for uuid := range uKeys {
+		bModified, inBase := base.uidentities[uuid]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].uidentities[uuid]; return ok },
+			func(i int) bool { return !srcs[i].uidentities[uuid].Equal(bModified) },
+		)
+		for _, i := range stale {
+			delete(srcs[i].uidentities, uuid)
+		}
+		if conf {
+			conflict("uidentities", uuid, func(i int) (string, bool) { modified, ok := srcs[i].uidentities[uuid]; return modified.String(), ok }, bModified.String())
+		}
+	}
+	m.printf("three-way profiles...\n")
+	pKeys := make(map[string]struct{})
+	for uuid := range base.profiles {
+		pKeys[uuid] = struct{}{}
+	}
+	for _, s := range srcs {
+		for uuid := range s.profiles {
+			pKeys[uuid] = struct{}{}
+		}
+	}
+	for uuid := range pKeys {
+		bp, inBase := base.profiles[uuid]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].profiles[uuid]; return ok },
+			func(i int) bool {
+				p := srcs[i].profiles[uuid]
+				return ProfilesDiffer(&p, &bp) || strPtrsDiffer(p.Gender, bp.Gender)
+			},
+		)
+		for _, i := range stale {
+			delete(srcs[i].profiles, uuid)
+		}
+		if conf {
+			conflict("profiles", uuid, func(i int) (string, bool) { p, ok := srcs[i].profiles[uuid]; return p.String(), ok }, bp.String())
+		}
+	}
+	m.printf("three-way identities...\n")
+	iKeys := make(map[string]struct{})
+	for id := range base.identities {
+		iKeys[id] = struct{}{}
+	}
+	for _, s := range srcs {
+		for id := range s.identities {
+			iKeys[id] = struct{}{}
+		}
+	}
+	for id := range iKeys {
+		bi, inBase := base.identities[id]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].identities[id]; return ok },
+			func(i int) bool {
+				iy := srcs[i].identities[id]
+				return IdentitiesDiffer(&iy, &bi) || strPtrsDiffer(iy.Username, bi.Username) || timePtrsDiffer(iy.LastModified, bi.LastModified)
+			},
+		)
+		for _, i := range stale {
+			delete(srcs[i].identities, id)
+		}
+		if conf {
+			conflict("identities", id, func(i int) (string, bool) { iy, ok := srcs[i].identities[id]; return iy.String(), ok }, bi.String())
+		}
+	}
+	m.printf("three-way enrollments...\n")
+	eKeys := make(map[EnrollmentKey]struct{})
+	for k := range base.enrollments {
+		eKeys[k] = struct{}{}
+	}
+	for _, s := range srcs {
+		for k := range s.enrollments {
+			eKeys[k] = struct{}{}
+		}
+	}
+	for k := range eKeys {
+		be, inBase := base.enrollments[k]
+		stale, conf := threeWayKey(
+			n,
+			inBase,
+			func(i int) bool { _, ok := srcs[i].enrollments[k]; return ok },
+			func(i int) bool { e := srcs[i].enrollments[k]; return EnrollmentsDiffer(&e, &be) },
+		)
+		for _, i := range stale {
+			delete(srcs[i].enrollments, k)
+		}
+		if conf {
+			conflict("enrollments", k.String(), func(i int) (string, bool) { e, ok := srcs[i].enrollments[k]; return e.String(), ok }, be.String())
+		}
+	}
+	return srcs
+}
+
+// restoreReferenced adds back rows deleted in some input but still referenced by merged rows
+// Archive tables hold history, rows are never restored because of them
+// all lists snapshots to take deleted rows from, in priority order
+func (m *Merger) restoreReferenced(merged *snapshot, all []*snapshot) {
+	restoreOrg := func(orgName, by string) {
+		lName := strings.ToLower(orgName)
+		_, ok := merged.orgNames[lName]
+		if ok {
+			return
+		}
+		// use casing from the highest priority database having the organization, not from the referencing row
+		for _, s := range all {
+			name, ok := s.orgNames[lName]
+			if ok {
+				orgName = name
+				break
+			}
+		}
+		m.printf("Organization %s deleted but still referenced by %s, keeping\n", orgName, by)
+		merged.orgNames[lName] = orgName
+	}
+	for _, do := range merged.domains {
+		restoreOrg(do.OrgName, "domain "+do.Domain)
+	}
+	for _, e := range merged.enrollments {
+		restoreOrg(e.OrgName, "enrollment "+e.String())
+	}
+	restoreUID := func(uuid, by string) {
+		_, ok := merged.uidentities[uuid]
+		if ok {
+			return
+		}
+		for _, s := range all {
+			modified, ok := s.uidentities[uuid]
+			if ok {
+				m.printf("Unique identity %s deleted but still referenced by %s, keeping\n", uuid, by)
+				merged.uidentities[uuid] = modified
+				return
+			}
+		}
+	}
+	for uuid := range merged.profiles {
+		restoreUID(uuid, "profile")
+	}
+	for id, iy := range merged.identities {
+		if iy.UUID != nil {
+			restoreUID(*iy.UUID, "identity "+id)
+		}
+	}
+	for _, e := range merged.enrollments {
+		restoreUID(e.UUID, "enrollment "+e.String())
+	}
+	for uuid, p := range merged.profiles {
+		if p.CountryCode == nil {
+			continue
+		}
+		_, ok := merged.countries[*p.CountryCode]
+		if ok {
+			continue
+		}
+		for _, s := range all {
+			c, ok := s.countries[*p.CountryCode]
+			if ok {
+				m.printf("Country %s deleted but still referenced by profile %s, keeping\n", c.Code, uuid)
+				merged.countries[c.Code] = c
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestThreeWayKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		inBase   bool
+		has      []bool
+		differs  []bool
+		stale    []int
+		conflict bool
+	}{
+		{name: "unchanged", inBase: true, has: []bool{true, true}, differs: []bool{false, false}},
+		{name: "changed in one", inBase: true, has: []bool{true, true}, differs: []bool{false, true}, stale: []int{0}},
+		{name: "changed in all", inBase: true, has: []bool{true, true}, differs: []bool{true, true}},
+		{name: "deleted in one", inBase: true, has: []bool{false, true}, differs: []bool{false, false}, stale: []int{1}},
+		{name: "deleted and modified", inBase: true, has: []bool{false, true, true}, differs: []bool{false, true, false}, stale: []int{2}, conflict: true},
+		{name: "added in one", has: []bool{false, true}, differs: []bool{false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale, conflict := threeWayKey(
+				len(tt.has),
+				tt.inBase,
+				func(i int) bool { return tt.has[i] },
+				func(i int) bool { return tt.differs[i] },
+			)
+			if len(stale) != len(tt.stale) || conflict != tt.conflict {
+				t.Fatalf("got stale %v, conflict %v, want %v, %v", stale, conflict, tt.stale, tt.conflict)
+			}
+			for i := range stale {
+				if stale[i] != tt.stale[i] {
+					t.Fatalf("got stale %v, want %v", stale, tt.stale)
+				}
+			}
+		})
+	}
+}
+
+func TestThreeWayKeepsInputs(t *testing.T) {
+	m := testMerger()
+	m.Base = openTestDump(t, testBase)
+	inputs := []*sql.DB{openTestDump(t, testBase), openTestDump(t, testChanged)}
+	res, err := m.merge(context.Background(), inputs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if do := res.merged.domains["google.com"]; do.IsTopDomain != 0 {
+		t.Fatalf("google.com changed only in the 2nd input was not merged: %v", do)
+	}
+	for i, s := range loadTest(t, inputs...) {
+		if res.inputs[i].checksum() != s.checksum() {
+			t.Fatalf("three-way merge modified %s", dbName(i+1))
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package shmerge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const nilStr string = "<nil>"
+const emailStr string = ", email:"
+const timeFormat string = "2006-01-02 15:04:05"
+const archivedAtFormat string = "2006-01-02 15:04:05.000000"
+
+// Country holds data from countries table
+type Country struct {
+	Code   string
+	Name   string
+	Alpha3 string
+}
+
+func (c Country) String() string {
+	return "{code:" + c.Code + ", name:" + c.Name + ", alpha3:" + c.Alpha3 + "}"
+}
+
+// DomainOrg holds data for domains_organizations table
+type DomainOrg struct {
+	ID          int64
+	Domain      string
+	IsTopDomain int
+	OrgID       int64
+	OrgName     string // computed
+	OrgIDMerged int64  // computed
+}
+
+func (do DomainOrg) String() string {
+	s := fmt.Sprintf("{id:%d, domain:%s, isTopDomain:%d, orgID:%d, orgName:%s, orgIDMerged:%d}", do.ID, do.Domain, do.IsTopDomain, do.OrgID, do.OrgName, do.OrgIDMerged)
+	return s
+}
+
+// Profile holds data for profiles table
+type Profile struct {
+	UUID        string
+	Name        *string
+	Email       *string
+	Gender      *string
+	GenderAcc   *int64
+	IsBot       *int
+	CountryCode *string
+}
+
+func (p Profile) String() string {
+	s := "{uuid:" + p.UUID + ", name:"
+	if p.Name != nil {
+		s += *p.Name
+	} else {
+		s += nilStr
+	}
+	s += emailStr
+	if p.Email != nil {
+		s += *p.Email
+	} else {
+		s += nilStr
+	}
+	s += ", gender:"
+	if p.Gender != nil {
+		s += *p.Gender
+	} else {
+		s += nilStr
+	}
+	s += ", genderAcc:"
+	if p.GenderAcc != nil {
+		s += strconv.Itoa(int(*p.GenderAcc))
+	} else {
+		s += nilStr
+	}
+	s += ", isBot:"
+	if p.IsBot != nil {
+		s += strconv.Itoa(*p.IsBot)
+	} else {
+		s += nilStr
+	}
+	s += ", countryCode:"
+	if p.CountryCode != nil {
+		s += *p.CountryCode
+	} else {
+		s += nilStr
+	}
+	s += "}"
+	return s
+}
+
+// ProfilesDiffer compares two profiles with the same uuid
+func ProfilesDiffer(p1, p2 *Profile) bool {
+	if p1.Name == nil && p2.Name != nil || p1.Name != nil && p2.Name == nil {
+		return true
+	}
+	if p1.Name != nil && p2.Name != nil && *p1.Name != *p2.Name {
+		return true
+	}
+	if p1.Email == nil && p2.Email != nil || p1.Email != nil && p2.Email == nil {
+		return true
+	}
+	if p1.Email != nil && p2.Email != nil && *p1.Email != *p2.Email {
+		return true
+	}
+	if p1.GenderAcc == nil && p2.GenderAcc != nil || p1.GenderAcc != nil && p2.GenderAcc == nil {
+		return true
+	}
+	if p1.GenderAcc != nil && p2.GenderAcc != nil && *p1.GenderAcc != *p2.GenderAcc {
+		return true
+	}
+	if p1.IsBot == nil && p2.IsBot != nil || p1.IsBot != nil && p2.IsBot == nil {
+		return true
+	}
+	if p1.IsBot != nil && p2.IsBot != nil && *p1.IsBot != *p2.IsBot {
+		return true
+	}
+	if p1.CountryCode == nil && p2.CountryCode != nil || p1.CountryCode != nil && p2.CountryCode == nil {
+		return true
+	}
+	if p1.CountryCode != nil && p2.CountryCode != nil && *p1.CountryCode != *p2.CountryCode {
+		return true
+	}
+	return false
+}
+
+// MergeProfiles merges two profiles with the same uuid, p1 has a higher priority
+func MergeProfiles(p1, p2 *Profile) Profile {
+	var p Profile
+	p.UUID = p1.UUID
+	p.Name = p1.Name
+	if p1.Name == nil && p2.Name != nil {
+		p.Name = p2.Name
+	}
+	p.Email = p1.Email
+	if p1.Email == nil && p2.Email != nil {
+		p.Email = p2.Email
+	}
+	p.Gender = p1.Gender
+	if p1.Gender == nil && p2.Gender != nil {
+		p.Gender = p2.Gender
+	}
+	p.GenderAcc = p1.GenderAcc
+	if p1.GenderAcc == nil && p2.GenderAcc != nil {
+		p.GenderAcc = p2.GenderAcc
+	}
+	if p1.GenderAcc != nil && p2.GenderAcc != nil {
+		if *p1.GenderAcc > *p2.GenderAcc && p1.Gender != nil {
+			p.GenderAcc = p1.GenderAcc
+			p.Gender = p1.Gender
+		}
+		if *p2.GenderAcc > *p1.GenderAcc && p2.Gender != nil {
+			p.GenderAcc = p2.GenderAcc
+			p.Gender = p2.Gender
+		}
+	}
+	p.IsBot = p1.IsBot
+	if p1.IsBot == nil && p2.IsBot != nil {
+		p.IsBot = p2.IsBot
+	}
+	p.CountryCode = p1.CountryCode
+	if p1.CountryCode == nil && p2.CountryCode != nil {
+		p.CountryCode = p2.CountryCode
+	}
+	return p
+}
+
+// Identity holds data for indentities table
+type Identity struct {
+	ID           string
+	Name         *string
+	Email        *string
+	Username     *string
+	Source       string
+	UUID         *string
+	LastModified *time.Time
+}
+
+func (i Identity) String() string {
+	s := "{id:" + i.ID + ", name:"
+	if i.Name != nil {
+		s += *i.Name
+	} else {
+		s += nilStr
+	}
+	s += emailStr
+	if i.Email != nil {
+		s += *i.Email
+	} else {
+		s += nilStr
+	}
+	s += ", username:"
+	if i.Username != nil {
+		s += *i.Username
+	} else {
+		s += nilStr
+	}
+	s += ", source:" + i.Source
+	s += ", uuid:"
+	if i.UUID != nil {
+		s += *i.UUID
+	} else {
+		s += nilStr
+	}
+	s += fmt.Sprintf(", lastModified:%+v}", i.LastModified)
+	return s
+}
+
+// IdentitiesDiffer compares two identities with the same id
+func IdentitiesDiffer(i1, i2 *Identity) bool {
+	if i1.Source != i2.Source {
+		return true
+	}
+	if i1.Name == nil && i2.Name != nil || i1.Name != nil && i2.Name == nil {
+		return true
+	}
+	if i1.Name != nil && i2.Name != nil && *i1.Name != *i2.Name {
+		return true
+	}
+	if i1.Email == nil && i2.Email != nil || i1.Email != nil && i2.Email == nil {
+		return true
+	}
+	if i1.Email != nil && i2.Email != nil && *i1.Email != *i2.Email {
+		return true
+	}
+	if i1.UUID == nil && i2.UUID != nil || i1.UUID != nil && i2.UUID == nil {
+		return true
+	}
+	if i1.UUID != nil && i2.UUID != nil && *i1.UUID != *i2.UUID {
+		return true
+	}
+	return false
+}
+
+// MergeIdentities merges two identities with the same id, i1 has a higher priority
+// Missing fields of i1 are taken from i2, source and last_modified come from the identity modified later:
+// i2 wins them only when both modification dates are known and i2 one is strictly newer (i1 wins ties)
+func MergeIdentities(i1, i2 *Identity) Identity {
+	var i Identity
+	i.ID = i1.ID
+	i.Name = i1.Name
+	if i1.Name == nil && i2.Name != nil {
+		i.Name = i2.Name
+	}
+	i.Email = i1.Email
+	if i1.Email == nil && i2.Email != nil {
+		i.Email = i2.Email
+	}
+	i.Username = i1.Username
+	if i1.Username == nil && i2.Username != nil {
+		i.Username = i2.Username
+	}
+	i.UUID = i1.UUID
+	if i1.UUID == nil && i2.UUID != nil {
+		i.UUID = i2.UUID
+	}
+	i.LastModified = i1.LastModified
+	if i1.LastModified == nil && i2.LastModified != nil {
+		i.LastModified = i2.LastModified
+	}
+	i.Source = i1.Source
+	if i1.LastModified != nil && i2.LastModified != nil && (*i2.LastModified).After(*i1.LastModified) {
+		i.LastModified = i2.LastModified
+		i.Source = i2.Source
+	}
+	return i
+}
+
+// Enrollment holds data for enrollments table
+type Enrollment struct {
+	ID          int64
+	Start       time.Time
+	End         time.Time
+	UUID        string
+	OrgID       int64
+	OrgName     string
+	OrgIDMerged int64
+}
+
+// EnrollmentsDiffer compares two enrollments with the same key.
+// We are comparing enrollments using 'EnrollmentKey' which already contains uuid, start, to
+// we are skipiing id filed because it is an auto incrementing PK, so we only have to compare
+// organization, we're not comparing its ID because it can be different on different databases (auto incrementing key)
+// So basically we only need to compare orgNames, case insensitive because organizations are merged by lower case name
+func EnrollmentsDiffer(e1, e2 *Enrollment) bool {
+	return !strings.EqualFold(e1.OrgName, e2.OrgName)
+}
+
+func (e Enrollment) String() string {
+	s := fmt.Sprintf("{id:%d, start:%+v, end: %+v, uuid:%s, orgID:%d, orgName:%s, orgIDMerged:%d}", e.ID, e.Start, e.End, e.UUID, e.OrgID, e.OrgName, e.OrgIDMerged)
+	return s
+}
+
+// EnrollmentKey holds key data for the enrollment
+type EnrollmentKey struct {
+	Start time.Time
+	End   time.Time
+	UUID  string
+}
+
+func (k EnrollmentKey) String() string {
+	return k.UUID + " " + k.Start.Format(timeFormat) + " " + k.End.Format(timeFormat)
+}
+
+// ArchiveKey holds key data for archive tables: natural key of the archived row and the archive time
+type ArchiveKey struct {
+	Key        string // uuid for uidentities and profiles, id for identities, EnrollmentKey.String() for enrollments
+	ArchivedAt time.Time
+}
+
+func (k ArchiveKey) String() string {
+	return k.Key + " " + k.ArchivedAt.Format(archivedAtFormat)
+}
@@ -0,0 +1,34 @@
+package shmerge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeIdentities(t *testing.T) {
+	str := func(s string) *string { return &s }
+	t1 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	tests := []struct {
+		name                string
+		i1, i2              Identity
+		source              string
+		lastModified        *time.Time
+		wantName, wantEmail *string
+	}{
+		{"first newer", Identity{ID: "i", Source: "git", LastModified: &t2}, Identity{ID: "i", Source: "github", LastModified: &t1}, "git", &t2, nil, nil},
+		{"second newer", Identity{ID: "i", Source: "git", LastModified: &t1}, Identity{ID: "i", Source: "github", LastModified: &t2}, "github", &t2, nil, nil},
+		{"tie", Identity{ID: "i", Source: "git", LastModified: &t1}, Identity{ID: "i", Source: "github", LastModified: &t1}, "git", &t1, nil, nil},
+		{"first unknown", Identity{ID: "i", Source: "git"}, Identity{ID: "i", Source: "github", LastModified: &t1}, "git", &t1, nil, nil},
+		{"second unknown", Identity{ID: "i", Source: "git", LastModified: &t1}, Identity{ID: "i", Source: "github"}, "git", &t1, nil, nil},
+		{"missing fields", Identity{ID: "i", Source: "git", Name: str("A")}, Identity{ID: "i", Source: "git", Name: str("B"), Email: str("b@x.com")}, "git", nil, str("A"), str("b@x.com")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MergeIdentities(&test.i1, &test.i2)
+			if got.Source != test.source || timePtrsDiffer(got.LastModified, test.lastModified) || strPtrsDiffer(got.Name, test.wantName) || strPtrsDiffer(got.Email, test.wantEmail) {
+				t.Fatalf("got %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// upsertOrder returns order of n inputs and the output database (index n), the output database is put at m.OutputPriority
+func (m *Merger) upsertOrder(order []int, n int) ([]int, error) {
+	pos := m.OutputPriority
+	if pos == 0 {
+		pos = n + 1
+	}
+	if pos < 1 || pos > n+1 {
+		return nil, fmt.Errorf("output priority %d must be between 1 and %d", m.OutputPriority, n+1)
+	}
+	res := append([]int{}, order[:pos-1]...)
+	res = append(res, n)
+	return append(res, order[pos-1:]...), nil
+}
+
+// pruneOutputOnly removes merged rows not present in any input (they came from the output database only)
+// Countries, organizations and uidentities referenced by kept rows are kept too
+func pruneOutputOnly(merged *snapshot, srcs []*snapshot) {
+	inAny := func(has func(s *snapshot) bool) bool {
+		for _, s := range srcs {
+			if has(s) {
+				return true
+			}
+		}
+		return false
+	}
+	for k := range merged.enrollments {
+		if !inAny(func(s *snapshot) bool { _, ok := s.enrollments[k]; return ok }) {
+			delete(merged.enrollments, k)
+		}
+	}
+	for id := range merged.identities {
+		if !inAny(func(s *snapshot) bool { _, ok := s.identities[id]; return ok }) {
+			delete(merged.identities, id)
+		}
+	}
+	for uuid := range merged.profiles {
+		if !inAny(func(s *snapshot) bool { _, ok := s.profiles[uuid]; return ok }) {
+			delete(merged.profiles, uuid)
+		}
+	}
+	for lDomain := range merged.domains {
+		if !inAny(func(s *snapshot) bool { _, ok := s.domains[lDomain]; return ok }) {
+			delete(merged.domains, lDomain)
+		}
+	}
+	for lBl := range merged.blacklist {
+		if !inAny(func(s *snapshot) bool { _, ok := s.blacklist[lBl]; return ok }) {
+			delete(merged.blacklist, lBl)
+		}
+	}
+	for k := range merged.uidentitiesArchive {
+		if !inAny(func(s *snapshot) bool { _, ok := s.uidentitiesArchive[k]; return ok }) {
+			delete(merged.uidentitiesArchive, k)
+		}
+	}
+	for k := range merged.profilesArchive {
+		if !inAny(func(s *snapshot) bool { _, ok := s.profilesArchive[k]; return ok }) {
+			delete(merged.profilesArchive, k)
+		}
+	}
+	for k := range merged.identitiesArchive {
+		if !inAny(func(s *snapshot) bool { _, ok := s.identitiesArchive[k]; return ok }) {
+			delete(merged.identitiesArchive, k)
+		}
+	}
+	for k := range merged.enrollmentsArchive {
+		if !inAny(func(s *snapshot) bool { _, ok := s.enrollmentsArchive[k]; return ok }) {
+			delete(merged.enrollmentsArchive, k)
+		}
+	}
+	uuids := make(map[string]struct{})
+	for _, p := range merged.profiles {
+		uuids[p.UUID] = struct{}{}
+	}
+	for _, iy := range merged.identities {
+		if iy.UUID != nil {
+			uuids[*iy.UUID] = struct{}{}
+		}
+	}
+	for k := range merged.enrollments {
+		uuids[k.UUID] = struct{}{}
+	}
+	for uuid := range merged.uidentities {
+		_, referenced := uuids[uuid]
+		if !referenced && !inAny(func(s *snapshot) bool { _, ok := s.uidentities[uuid]; return ok }) {
+			delete(merged.uidentities, uuid)
+		}
+	}
+	orgs := make(map[string]struct{})
+	for _, do := range merged.domains {
+		orgs[strings.ToLower(do.OrgName)] = struct{}{}
+	}
+	for _, e := range merged.enrollments {
+		orgs[strings.ToLower(e.OrgName)] = struct{}{}
+	}
+	for lName := range merged.orgNames {
+		_, referenced := orgs[lName]
+		if !referenced && !inAny(func(s *snapshot) bool { _, ok := s.orgNames[lName]; return ok }) {
+			delete(merged.orgNames, lName)
+		}
+	}
+	codes := make(map[string]struct{})
+	for _, p := range merged.profiles {
+		if p.CountryCode != nil {
+			codes[*p.CountryCode] = struct{}{}
+		}
+	}
+	for code := range merged.countries {
+		_, referenced := codes[code]
+		if !referenced && !inAny(func(s *snapshot) bool { _, ok := s.countries[code]; return ok }) {
+			delete(merged.countries, code)
+		}
+	}
+}
+
+// deleteStmt is a delete statement postponed until all inserts and updates are done
+type deleteStmt struct {
+	key   string
+	query string
+	args  []interface{}
+}
+
+// diffWriter changes a single table: inserts are batched, updates are run one by one, deletes are postponed
+type diffWriter struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	table    string
+	ins      *batchInserter
+	deletes  []deleteStmt
+	inserted int
+	updated  int
+}
+
+// newDiffWriter returns diff writer for table, inserting into columns
+func (m *Merger) newDiffWriter(ctx context.Context, tx *sql.Tx, table string, columns ...string) *diffWriter {
+	return &diffWriter{ctx: ctx, tx: tx, table: table, ins: m.newInserter(ctx, tx, table, columns...)}
+}
+
+func (w *diffWriter) insert(key string, values ...interface{}) error {
+	w.inserted++
+	return w.ins.add(key, values...)
+}
+
+func (w *diffWriter) update(key, query string, args ...interface{}) error {
+	w.updated++
+	_, err := w.tx.ExecContext(w.ctx, query, args...)
+	return wrapError(err, w.table, OutputDB, "update", key)
+}
+
+func (w *diffWriter) delete(key, query string, args ...interface{}) {
+	w.deletes = append(w.deletes, deleteStmt{key: key, query: query, args: args})
+}
+
+// replace deletes a row right away and inserts its new version, for tables without a primary key
+func (w *diffWriter) replace(key, query string, args []interface{}, values ...interface{}) error {
+	w.updated++
+	_, err := w.tx.ExecContext(w.ctx, query, args...)
+	if err != nil {
+		return wrapError(err, w.table, OutputDB, "delete", key)
+	}
+	return w.ins.add(key, values...)
+}
+
+// runDeletes runs all postponed deletes
+func (w *diffWriter) runDeletes() error {
+	for _, d := range w.deletes {
+		_, err := w.tx.ExecContext(w.ctx, d.query, d.args...)
+		if err != nil {
+			return wrapError(err, w.table, OutputDB, "delete", d.key)
+		}
+	}
+	return nil
+}
+
+// writeDiff changes tables of a database holding target into merged data s using tx, only rows that differ are written
+// Rows are inserted and updated in foreign keys order and deleted in the reverse order, all IDs are taken from ids
+func (m *Merger) writeDiff(ctx context.Context, tx *sql.Tx, target, s *snapshot, ids *mergedIDs) error {
+	var writers []*diffWriter
+	// next flushes inserts into the previous table and returns writer for the next one
+	next := func(table string, columns ...string) (*diffWriter, error) {
+		if len(writers) > 0 {
+			err := writers[len(writers)-1].ins.flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+		w := m.newDiffWriter(ctx, tx, table, columns...)
+		writers = append(writers, w)
+		return w, nil
+	}
+	w, err := next("countries", "code", "name", "alpha3")
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for code := range s.countries {
+		keys = append(keys, code)
+	}
+	sort.Strings(keys)
+	for _, code := range keys {
+		c := s.countries[code]
+		tc, ok := target.countries[code]
+		if !ok {
+			err = w.insert(code, c.Code, c.Name, c.Alpha3)
+		} else if tc != c {
+			err = w.update(code, "update countries set name = ?, alpha3 = ? where code = ?", c.Name, c.Alpha3, c.Code)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for code := range target.countries {
+		if _, ok := s.countries[code]; !ok {
+			w.delete(code, "delete from countries where code = ?", code)
+		}
+	}
+	w, err = next("organizations", "id", "name")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for lName := range s.orgNames {
+		keys = append(keys, lName)
+	}
+	sort.Strings(keys)
+	for _, lName := range keys {
+		name := s.orgNames[lName]
+		id := ids.orgs[lName]
+		// IDs are kept only for organizations present in target
+		tName, ok := target.orgs[id]
+		if !ok {
+			err = w.insert(name, id, name)
+		} else if tName != name {
+			err = w.update(name, "update organizations set name = ? where id = ?", name, id)
+		}
+		if err != nil {
+			return err
+		}
+		s.orgs[id] = name
+	}
+	for id, name := range target.orgs {
+		if newID, ok := ids.orgs[strings.ToLower(name)]; !ok || newID != id {
+			w.delete(name, "delete from organizations where id = ?", id)
+		}
+	}
+	mapOrg := func(table, orgName, key string) (int64, error) {
+		id, ok := ids.orgs[strings.ToLower(orgName)]
+		if !ok {
+			return 0, wrapError(fmt.Errorf("%w Name %s", ErrUnknownOrganization, orgName), table, OutputDB, "map organization", key)
+		}
+		return id, nil
+	}
+	w, err = next("domains_organizations", "id", "domain", "is_top_domain", "organization_id")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for lDomain := range s.domains {
+		keys = append(keys, lDomain)
+	}
+	sort.Strings(keys)
+	for _, lDomain := range keys {
+		do := s.domains[lDomain]
+		do.OrgIDMerged, err = mapOrg("domains_organizations", do.OrgName, do.Domain)
+		if err != nil {
+			return err
+		}
+		do.ID = ids.domains[lDomain]
+		tdo, ok := target.domains[lDomain]
+		if !ok {
+			err = w.insert(do.Domain, do.ID, do.Domain, do.IsTopDomain, do.OrgIDMerged)
+		} else if tdo.Domain != do.Domain || tdo.IsTopDomain != do.IsTopDomain || tdo.OrgID != do.OrgIDMerged {
+			err = w.update(do.Domain, "update domains_organizations set domain = ?, is_top_domain = ?, organization_id = ? where id = ?", do.Domain, do.IsTopDomain, do.OrgIDMerged, do.ID)
+		}
+		if err != nil {
+			return err
+		}
+		s.domains[lDomain] = do
+	}
+	for lDomain, tdo := range target.domains {
+		if _, ok := s.domains[lDomain]; !ok {
+			w.delete(tdo.Domain, "delete from domains_organizations where id = ?", tdo.ID)
+		}
+	}
+	w, err = next("matching_blacklist", "excluded")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for lBl := range s.blacklist {
+		keys = append(keys, lBl)
+	}
+	sort.Strings(keys)
+	for _, lBl := range keys {
+		// merged blacklist is written lower case, just like by writeTables
+		tBl, ok := target.blacklist[lBl]
+		if !ok {
+			err = w.insert(lBl, lBl)
+		} else if tBl != lBl {
+			err = w.update(lBl, "update matching_blacklist set excluded = ? where excluded = ?", lBl, tBl)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for lBl, tBl := range target.blacklist {
+		if _, ok := s.blacklist[lBl]; !ok {
+			w.delete(tBl, "delete from matching_blacklist where excluded = ?", tBl)
+		}
+	}
+	w, err = next("uidentities", "uuid", "last_modified")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for uuid := range s.uidentities {
+		keys = append(keys, uuid)
+	}
+	sort.Strings(keys)
+	for _, uuid := range keys {
+		modified := s.uidentities[uuid]
+		tModified, ok := target.uidentities[uuid]
+		if !ok {
+			err = w.insert(uuid, uuid, modified)
+		} else if !tModified.Equal(modified) {
+			err = w.update(uuid, "update uidentities set last_modified = ? where uuid = ?", modified, uuid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for uuid := range target.uidentities {
+		if _, ok := s.uidentities[uuid]; !ok {
+			w.delete(uuid, "delete from uidentities where uuid = ?", uuid)
+		}
+	}
+	w, err = next("profiles", "uuid", "name", "email", "gender", "gender_acc", "is_bot", "country_code")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for uuid := range s.profiles {
+		keys = append(keys, uuid)
+	}
+	sort.Strings(keys)
+	for _, uuid := range keys {
+		p := s.profiles[uuid]
+		tp, ok := target.profiles[uuid]
+		if !ok {
+			err = w.insert(uuid, p.UUID, p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode)
+		} else if tp.String() != p.String() {
+			err = w.update(uuid, "update profiles set name = ?, email = ?, gender = ?, gender_acc = ?, is_bot = ?, country_code = ? where uuid = ?", p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode, p.UUID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for uuid := range target.profiles {
+		if _, ok := s.profiles[uuid]; !ok {
+			w.delete(uuid, "delete from profiles where uuid = ?", uuid)
+		}
+	}
+	w, err = next("identities", "id", "name", "email", "username", "source", "uuid", "last_modified")
+	if err != nil {
+		return err
+	}
+	keys = keys[:0]
+	for id := range s.identities {
+		keys = append(keys, id)
+	}
+	sort.Strings(keys)
+	for _, id := range keys {
+		i := s.identities[id]
+		ti, ok := target.identities[id]
+		if !ok {
+			err = w.insert(id, i.ID, i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified)
+		} else if ti.String() != i.String() {
+			err = w.update(id, "update identities set name = ?, email = ?, username = ?, source = ?, uuid = ?, last_modified = ? where id = ?", i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified, i.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for id := range target.identities {
+		if _, ok := s.identities[id]; !ok {
+			w.delete(id, "delete from identities where id = ?", id)
+		}
+	}
+	w, err = next("enrollments", "id", "start", "end", "uuid", "organization_id")
+	if err != nil {
+		return err
+	}
+	for _, k := range sortedEnrollmentKeys(s.enrollments) {
+		e := s.enrollments[k]
+		e.OrgIDMerged, err = mapOrg("enrollments", e.OrgName, e.UUID)
+		if err != nil {
+			return err
+		}
+		e.ID = ids.enrollments[k]
+		te, ok := target.enrollments[k]
+		if !ok {
+			err = w.insert(k.String(), e.ID, e.Start, e.End, e.UUID, e.OrgIDMerged)
+		} else if te.OrgID != e.OrgIDMerged {
+			err = w.update(k.String(), "update enrollments set organization_id = ? where id = ?", e.OrgIDMerged, e.ID)
+		}
+		if err != nil {
+			return err
+		}
+		s.enrollments[k] = e
+	}
+	for k, te := range target.enrollments {
+		if _, ok := s.enrollments[k]; !ok {
+			w.delete(k.String(), "delete from enrollments where id = ?", te.ID)
+		}
+	}
+	err = m.writeArchivesDiff(ctx, tx, target, s, mapOrg, next)
+	if err != nil {
+		return err
+	}
+	err = writers[len(writers)-1].ins.flush()
+	if err != nil {
+		return err
+	}
+	for i := len(writers) - 1; i >= 0; i-- {
+		err = writers[i].runDeletes()
+		if err != nil {
+			return err
+		}
+	}
+	for _, w := range writers {
+		if w.inserted+w.updated+len(w.deletes) > 0 {
+			m.printf("%s: %d inserted, %d updated, %d deleted\n", w.table, w.inserted, w.updated, len(w.deletes))
+		}
+	}
+	return nil
+}
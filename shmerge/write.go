@@ -0,0 +1,243 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// mergedTables lists all merged tables in foreign keys order, archive tables (without foreign keys) are last
+var mergedTables = append([]string{
+	"countries",
+	"organizations",
+	"domains_organizations",
+	"matching_blacklist",
+	"uidentities",
+	"profiles",
+	"identities",
+	"enrollments",
+}, archiveTables...)
+
+// writeDatabase writes into the output database using write in a single transaction
+// On any error the transaction is rolled back, so the output database keeps its previous contents
+// Context passed to write holds the placeholders limit of db used by inserters
+func (m *Merger) writeDatabase(ctx context.Context, db *sql.DB, write func(ctx context.Context, tx *sql.Tx) error) error {
+	m.printf("writing output database...\n")
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return wrapError(err, "", OutputDB, "begin transaction", "")
+	}
+	err = write(context.WithValue(ctx, placeholdersKey{}, maxPlaceholders(db)), tx)
+	if err != nil {
+		m.printf("rolling back output database changes\n")
+		rErr := tx.Rollback()
+		if rErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rErr)
+		}
+		return err
+	}
+	return wrapError(tx.Commit(), "", OutputDB, "commit transaction", "")
+}
+
+// writeTables replaces contents of all merged tables using tx, rows are inserted in batches of m.BatchSize
+// All IDs are taken from ids and filled in s (s.orgs, IDs and OrgIDMerged fields)
+func (m *Merger) writeTables(ctx context.Context, tx *sql.Tx, s *snapshot, ids *mergedIDs) error {
+	for i := len(mergedTables) - 1; i >= 0; i-- {
+		_, err := tx.ExecContext(ctx, "delete from "+mergedTables[i])
+		if err != nil {
+			return wrapError(err, mergedTables[i], OutputDB, "delete", "")
+		}
+	}
+	// All tables are written in keys order and all IDs are allocated in that order, so the output doesn't depend on map iteration order
+	var keys []string
+	for code := range s.countries {
+		keys = append(keys, code)
+	}
+	sort.Strings(keys)
+	ins := m.newInserter(ctx, tx, "countries", "code", "name", "alpha3")
+	for _, code := range keys {
+		c := s.countries[code]
+		err := ins.add(c.Code, c.Code, c.Name, c.Alpha3)
+		if err != nil {
+			return err
+		}
+	}
+	err := ins.flush()
+	if err != nil {
+		return err
+	}
+	// Organization, domain and enrollment IDs are allocated before inserting (tables are empty), so they don't need to be read back
+	ins = m.newInserter(ctx, tx, "organizations", "id", "name")
+	keys = keys[:0]
+	for lName := range s.orgNames {
+		keys = append(keys, lName)
+	}
+	sort.Strings(keys)
+	for _, lName := range keys {
+		name := s.orgNames[lName]
+		id := ids.orgs[lName]
+		err := ins.add(name, id, name)
+		if err != nil {
+			return err
+		}
+		s.orgs[id] = name
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	// mapOrg maps organization name into merged organization ID - must succeed
+	mapOrg := func(table, orgName, key string) (int64, error) {
+		id, ok := ids.orgs[strings.ToLower(orgName)]
+		if !ok {
+			return 0, wrapError(fmt.Errorf("%w Name %s", ErrUnknownOrganization, orgName), table, OutputDB, "map organization", key)
+		}
+		return id, nil
+	}
+	ins = m.newInserter(ctx, tx, "domains_organizations", "id", "domain", "is_top_domain", "organization_id")
+	keys = keys[:0]
+	for lDomain := range s.domains {
+		keys = append(keys, lDomain)
+	}
+	sort.Strings(keys)
+	for _, lDomain := range keys {
+		do := s.domains[lDomain]
+		var err error
+		do.OrgIDMerged, err = mapOrg("domains_organizations", do.OrgName, do.Domain)
+		if err != nil {
+			return err
+		}
+		do.ID = ids.domains[lDomain]
+		err = ins.add(do.Domain, do.ID, do.Domain, do.IsTopDomain, do.OrgIDMerged)
+		if err != nil {
+			return err
+		}
+		s.domains[lDomain] = do
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "matching_blacklist", "excluded")
+	keys = keys[:0]
+	for lBl := range s.blacklist {
+		keys = append(keys, lBl)
+	}
+	sort.Strings(keys)
+	for _, lBl := range keys {
+		err := ins.add(lBl, lBl)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	err = m.writeUUIDTables(ctx, tx, s, ids.enrollments, mapOrg)
+	if err != nil {
+		return err
+	}
+	return m.writeArchives(ctx, tx, s, mapOrg)
+}
+
+// writeUUIDTables inserts uidentities, profiles, identities and enrollments using tx
+// Enrollments get IDs from enrollmentIDs, mapOrg maps organization name into merged organization ID
+func (m *Merger) writeUUIDTables(ctx context.Context, tx *sql.Tx, s *snapshot, enrollmentIDs map[EnrollmentKey]int64, mapOrg func(table, orgName, key string) (int64, error)) error {
+	var keys []string
+	ins := m.newInserter(ctx, tx, "uidentities", "uuid", "last_modified")
+	for uuid := range s.uidentities {
+		keys = append(keys, uuid)
+	}
+	sort.Strings(keys)
+	for _, uuid := range keys {
+		err := ins.add(uuid, uuid, s.uidentities[uuid])
+		if err != nil {
+			return err
+		}
+	}
+	err := ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "profiles", "uuid", "name", "email", "gender", "gender_acc", "is_bot", "country_code")
+	keys = keys[:0]
+	for uuid := range s.profiles {
+		keys = append(keys, uuid)
+	}
+	sort.Strings(keys)
+	for _, uuid := range keys {
+		p := s.profiles[uuid]
+		err := ins.add(p.UUID, p.UUID, p.Name, p.Email, p.Gender, p.GenderAcc, p.IsBot, p.CountryCode)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "identities", "id", "name", "email", "username", "source", "uuid", "last_modified")
+	keys = keys[:0]
+	for id := range s.identities {
+		keys = append(keys, id)
+	}
+	sort.Strings(keys)
+	for _, id := range keys {
+		i := s.identities[id]
+		err := ins.add(i.ID, i.ID, i.Name, i.Email, i.Username, i.Source, i.UUID, i.LastModified)
+		if err != nil {
+			return err
+		}
+	}
+	err = ins.flush()
+	if err != nil {
+		return err
+	}
+	ins = m.newInserter(ctx, tx, "enrollments", "id", "start", "end", "uuid", "organization_id")
+	for _, k := range sortedEnrollmentKeys(s.enrollments) {
+		e := s.enrollments[k]
+		var err error
+		e.OrgIDMerged, err = mapOrg("enrollments", e.OrgName, e.UUID)
+		if err != nil {
+			return err
+		}
+		e.ID = enrollmentIDs[k]
+		err = ins.add(k.String(), e.ID, e.Start, e.End, e.UUID, e.OrgIDMerged)
+		if err != nil {
+			return err
+		}
+		s.enrollments[k] = e
+	}
+	return ins.flush()
+}
+
+// sortedEnrollmentKeys returns keys of enrollments sorted by uuid, start and end
+func sortedEnrollmentKeys(enrollments map[EnrollmentKey]Enrollment) []EnrollmentKey {
+	keys := make([]EnrollmentKey, 0, len(enrollments))
+	for k := range enrollments {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].UUID != keys[j].UUID {
+			return keys[i].UUID < keys[j].UUID
+		}
+		if !keys[i].Start.Equal(keys[j].Start) {
+			return keys[i].Start.Before(keys[j].Start)
+		}
+		return keys[i].End.Before(keys[j].End)
+	})
+	return keys
+}
+
+// sortArchiveKeys sorts archive keys by key and archive time
+func sortArchiveKeys(keys []ArchiveKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Key != keys[j].Key {
+			return keys[i].Key < keys[j].Key
+		}
+		return keys[i].ArchivedAt.Before(keys[j].ArchivedAt)
+	})
+}
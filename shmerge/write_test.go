@@ -0,0 +1,47 @@
+package shmerge
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testCased holds organizations, domains and blacklist entries differing only in case from testBase ones
+const testCased = `
+INSERT INTO countries VALUES ('PL','Polska','POL'),('DE','Germany','DEU');
+INSERT INTO organizations VALUES (3,'google'),(4,'cncf'),(5,'CNCF'),(6,'Microsoft');
+INSERT INTO domains_organizations VALUES (3,'Google.com',0,3),(4,'CNCF.io',1,5),(5,'cncf.IO',1,4),(6,'microsoft.com',1,6);
+INSERT INTO matching_blacklist VALUES ('Root'),('ROOT'),('bot');
+INSERT INTO uidentities VALUES ('u2','2021-01-01 00:00:00.000000'),('u3','2021-01-01 00:00:00.000000');
+INSERT INTO profiles VALUES ('u2',NULL,'two@y.com','female',90,1,'DE'),('u3','User Three',NULL,NULL,NULL,0,NULL);
+INSERT INTO identities VALUES ('i2','User Two','two@y.com','u2','github','u2','2021-01-01 00:00:00.000000'),('i3','User Three',NULL,'u3','git','u3','2021-01-01 00:00:00.000000');
+INSERT INTO enrollments VALUES (7,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',6),(8,'1900-01-01 00:00:00','2100-01-01 00:00:00','u3',4),(9,'2000-01-01 00:00:00','2010-01-01 00:00:00','u3',3);
+INSERT INTO enrollments_archive VALUES ('2019-01-01 00:00:00.000000',5,'1900-01-01 00:00:00','2100-01-01 00:00:00','u2',3);
+`
+
+func TestDeterministic(t *testing.T) {
+	staging, err := OpenDump("../dump_staging.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []*sql.DB{staging, openTestDump(t, testBase), openTestDump(t, testCased)}
+	var outputs [][]byte
+	for i := 0; i < 2; i++ {
+		path := filepath.Join(t.TempDir(), "merged.sql")
+		err = testMerger().Merge(context.Background(), inputs, CreateDump(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, data)
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Fatal("merging the same inputs twice gave different output databases")
+	}
+}
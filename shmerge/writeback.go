@@ -0,0 +1,73 @@
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// WriteBack merges input databases and writes the merged result back into every input, so they all end up logically identical
+// Only rows that differ are written into each input (like when upserting), every input keeps its own organization, domain
+// and enrollment IDs, new rows get IDs not used in it, so organization_id references are remapped per input
+// Inputs are written in separate transactions, they are committed only after all of them were written successfully
+func (m *Merger) WriteBack(ctx context.Context, inputs []*sql.DB) error {
+	if m.Upsert || m.Incremental || m.PreserveIDs || m.IDMap != nil || m.IDMapTable != "" {
+		return fmt.Errorf("write back cannot be combined with upsert, incremental merge, preserving IDs or ID mapping")
+	}
+	res, err := m.merge(ctx, inputs, nil)
+	if err != nil {
+		return err
+	}
+	done, err := m.reportPlan(res.plan)
+	if err != nil || done {
+		return err
+	}
+	var txs []*sql.Tx
+	// rollback rolls back transactions not committed yet, starting from the from-th one
+	rollback := func(from int, err error) error {
+		m.printf("rolling back input databases changes\n")
+		for i := from; i < len(txs); i++ {
+			rErr := txs[i].Rollback()
+			if rErr != nil {
+				err = fmt.Errorf("%w (%s rollback failed: %v)", err, dbName(i+1), rErr)
+			}
+		}
+		return err
+	}
+	for i, db := range inputs {
+		dbNum := i + 1
+		m.printf("writing back into %s...\n", dbName(dbNum))
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return rollback(0, wrapError(err, "", dbNum, "begin transaction", ""))
+		}
+		txs = append(txs, tx)
+		// inputs as read, a three-way merge doesn't drop its unchanged rows from them
+		target := res.inputs[i]
+		err = m.writeDiff(ctx, tx, target, res.merged, allocateIDs(res.merged, target, true))
+		if err != nil {
+			return rollback(0, inputError(err, dbNum))
+		}
+	}
+	for i, tx := range txs {
+		err = tx.Commit()
+		if err != nil {
+			err = wrapError(err, "", i+1, "commit transaction", "")
+			if i > 0 {
+				err = fmt.Errorf("%w (%d input databases already committed, run write back again)", err, i)
+			}
+			return rollback(i+1, err)
+		}
+	}
+	return nil
+}
+
+// inputError changes the database number of err from the output database to dbNum, writeDiff reports errors as the output database ones
+func inputError(err error, dbNum int) error {
+	var e *Error
+	if errors.As(err, &e) && e.DB == OutputDB {
+		e.DB = dbNum
+	}
+	return err
+}
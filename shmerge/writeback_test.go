@@ -0,0 +1,34 @@
+//go:build cgo
+// +build cgo
+
+package shmerge
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestWriteBackThreeWay(t *testing.T) {
+	ctx := context.Background()
+	inputs := []*sql.DB{openTestSQLite(t, testBase), openTestSQLite(t, testChanged)}
+	m := testMerger()
+	m.Base = openTestDump(t, testBase)
+	err := m.WriteBack(ctx, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snaps := loadTest(t, inputs...)
+	for i, s := range snaps {
+		if do := s.domains["google.com"]; do.IsTopDomain != 0 {
+			t.Fatalf("%s not changed: %v", dbName(i+1), do)
+		}
+		if len(s.orgs) != 2 || len(s.domains) != 2 || len(s.enrollments) != 2 {
+			t.Fatalf("%s has duplicated rows: %v, %v, %v", dbName(i+1), s.orgs, s.domains, s.enrollments)
+		}
+	}
+	// inputs keep their own IDs
+	if snaps[0].domains["google.com"].ID != 2 || snaps[1].domains["google.com"].ID != 8 {
+		t.Fatalf("domain IDs changed: %v, %v", snaps[0].domains["google.com"], snaps[1].domains["google.com"])
+	}
+}
@@ -0,0 +1,7 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+// SQLite driver needs cgo, build with CGO_ENABLED=1 to use SH_DIALECT=sqlite3
+import _ "github.com/mattn/go-sqlite3"